@@ -1,61 +1,67 @@
 package kclgo
 
-import (
-	"encoding/json"
-	"errors"
-)
+import "errors"
 
 var _ CheckPointer = (*KCLCheckPointer)(nil)
 
+// The daemon only checkpoints at real sequence numbers, the sentinels (ShardEnd included) can't be asked for. At the
+// end of a shard checkpoint with a nil sequence number instead, the daemon records SHARD_END itself.
+var ErrSentinelCheckPoint = errors.New("kclgo: can't checkpoint at a sentinel sequence number")
+
 type KCLCheckPointer struct {
 	handler *IoHandler
 }
 
-// CheckPoints at a particular sequence number you provide or if no sequence number is given, the checkpoint will
-// be at the end of the most recently delivered list of records
-func (c *KCLCheckPointer) CheckPoint(sequenceNumber string, subSequenceNumber int) error {
-	var seq *string
-	if sequenceNumber != "" {
-		seq = &sequenceNumber
+// CheckPoints at a particular sequence number you provide or if no sequence number is given (nil), the checkpoint
+// will be at the end of the most recently delivered list of records. Sentinels fail with ErrSentinelCheckPoint.
+func (c *KCLCheckPointer) CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error) {
+	if sequence != nil && sequence.IsSentinel() {
+		return CheckPointResult{}, ErrSentinelCheckPoint
 	}
-
 	message := CheckPointRequest{
-		Action:            "checkpoint",
-		SequenceNumber:    seq,
-		SubSequenceNumber: subSequenceNumber,
+		Action: "checkpoint",
 	}
-	err := c.handler.WriteCheckPointRequest(message)
-	if err != nil {
-		return err
+	if sequence != nil && !sequence.IsZero() {
+		seq := sequence.SequenceNumber
+		message.SequenceNumber = &seq
+		message.SubSequenceNumber = sequence.SubSequenceNumber
 	}
-	return c.getResponse()
-}
-
-func (c *KCLCheckPointer) getResponse() error {
-	dat, err := c.handler.ReadLine()
+	responses, err := c.handler.demux.expectCheckPoint()
 	if err != nil {
-		return err
+		return CheckPointResult{}, err
 	}
-
-	var response checkPointResponse
-	if err = json.Unmarshal([]byte(dat), &response); err != nil {
-		return err
+	if err = c.handler.WriteCheckPointRequest(message); err != nil {
+		c.handler.demux.cancelCheckPoint(responses)
+		return CheckPointResult{}, err
 	}
+	return c.getResponse(<-responses)
+}
 
-	if response.Error != nil {
-		return CheckPointError(errors.New(*response.Error))
+func (c *KCLCheckPointer) CheckPointRecord(record Record) (CheckPointResult, error) {
+	seq := record.SequenceNumber
+	return c.CheckPoint(&seq)
+}
+
+func (c *KCLCheckPointer) getResponse(msg demuxMessage) (CheckPointResult, error) {
+	if msg.err != nil {
+		return CheckPointResult{}, msg.err
 	}
 
-	if response.Action != "checkpoint" {
+	response, ok := msg.action.(*checkPointResponse)
+	if !ok {
 		// We are in an invalid state. We will raise a checkpoint exception
 		// to the RecordProcessor indicating that the KCL (or KCLgo) is in
 		// an invalid state. See KCL documentation for description of this
 		// exception. Note that the documented guidance is that this exception
 		// is NOT retryable so the client code should exit.
-		return CheckPointError(errors.New("InvalidStateException"))
+		return CheckPointResult{}, newCheckPointError(ErrInvalidState.Error())
+	}
+
+	if response.Error != nil {
+		return CheckPointResult{}, newCheckPointError(*response.Error)
 	}
 
-	return nil
+	return response.result(), nil
 }
 
 func NewCheckPointer(handler *IoHandler) *KCLCheckPointer {
@@ -0,0 +1,93 @@
+package kclgo
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// The messageType of the envelopes CloudWatch Logs sends to check it can write to the stream, they have no log events
+// worth handling
+const CloudWatchLogsControlMessage = "CONTROL_MESSAGE"
+
+// The envelope a CloudWatch Logs subscription filter puts on the stream, gzipped
+type cloudWatchLogsData struct {
+	MessageType         string   `json:"messageType"`
+	Owner               string   `json:"owner"`
+	LogGroup            string   `json:"logGroup"`
+	LogStream           string   `json:"logStream"`
+	SubscriptionFilters []string `json:"subscriptionFilters"`
+	LogEvents           []struct {
+		ID        string `json:"id"`
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	} `json:"logEvents"`
+}
+
+// CloudWatchLogEvent is a single log event delivered by a CloudWatch Logs subscription filter, along with where it
+// was logged
+type CloudWatchLogEvent struct {
+	ID string
+	// Milliseconds since the epoch
+	Timestamp int64
+	Message   string
+
+	// The account the log group belongs to
+	Owner               string
+	LogGroup            string
+	LogStream           string
+	SubscriptionFilters []string
+}
+
+func (e CloudWatchLogEvent) Time() time.Time {
+	return time.Unix(e.Timestamp/1000, (e.Timestamp%1000)*int64(time.Millisecond))
+}
+
+// Unpacks a subscription filter envelope into its log events, control messages have none. The envelope is gunzipped
+// here unless KCLConfig.ContentEncoding has already done it.
+func CloudWatchLogsDecoder() Decoder[[]CloudWatchLogEvent] {
+	return DecoderFunc[[]CloudWatchLogEvent](func(data []byte) ([]CloudWatchLogEvent, error) {
+		if SniffContentEncoding(data) == ContentEncodingGzip {
+			var err error
+			if data, err = (&ContentDecoder{Encoding: ContentEncodingGzip}).Decode(data); err != nil {
+				return nil, err
+			}
+		}
+
+		var envelope cloudWatchLogsData
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		if envelope.MessageType == CloudWatchLogsControlMessage {
+			return nil, nil
+		}
+
+		events := make([]CloudWatchLogEvent, len(envelope.LogEvents))
+		for i, e := range envelope.LogEvents {
+			events[i] = CloudWatchLogEvent{
+				ID:                  e.ID,
+				Timestamp:           e.Timestamp,
+				Message:             e.Message,
+				Owner:               envelope.Owner,
+				LogGroup:            envelope.LogGroup,
+				LogStream:           envelope.LogStream,
+				SubscriptionFilters: envelope.SubscriptionFilters,
+			}
+		}
+		return events, nil
+	})
+}
+
+// Builds a RecordProcessingFunc that hands each log event in a record to handle, in order. The record is only done
+// once every event in it has been handled, so it is checkpointed (and retried, events that had already been handled
+// included) as a whole.
+func NewCloudWatchLogsProcessingFunc(handle func(context.Context, CloudWatchLogEvent, RecordMeta) error) *TypedProcessingFunc[[]CloudWatchLogEvent] {
+	return NewTypedProcessingFunc(CloudWatchLogsDecoder(), func(ctx context.Context, events []CloudWatchLogEvent, meta RecordMeta) error {
+		for _, e := range events {
+			if err := handle(ctx, e, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
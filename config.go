@@ -1,9 +1,11 @@
 package kclgo
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/rickar/props"
 )
@@ -22,6 +24,36 @@ type KCLConfig struct {
 	OutLoggerFileName     string
 	ErrLogger             LoggerInterface
 	ErrLoggerFileName     string
+	// Messages from the daemon larger than this fail with ErrMessageTooLarge, 0 means no limit
+	MaxMessageBytes int
+	// Decode messages straight off the input instead of reading whole lines first, see RecordStreamProcessor
+	StreamingDecode bool
+	// How many records the DefaultRecordProcessor processes at once. Records with the same partition key are
+	// still processed in order, 1 (or less) processes every record in order.
+	ProcessingWorkers int
+	// Hand KPL aggregated records to the processing func as they are instead of expanding them into user records
+	DisableDeaggregation bool
+	// How record payloads are compressed, Record.BinaryData decompresses them. The zero value leaves them alone.
+	ContentEncoding ContentEncoding
+	// The most a payload may decompress to, 0 means DefaultMaxDecodedBytes
+	MaxDecodedBytes int64
+	// How records that fail are retried by the DefaultRecordProcessor, the zero value never retries
+	RecordRetry RetryPolicy
+	// How long each attempt at processing a record may take, 0 means no limit. Only a ContextRecordProcessingFunc
+	// sees the deadline, the DefaultRecordProcessor can't stop a func that doesn't look at its context.
+	RecordTimeout time.Duration
+	// What happens when a record still fails after being retried, also applies to errors from a RecordProcessor
+	FailurePolicy FailurePolicy
+	// Where FailurePolicyDeadLetter sends records that still fail after being retried. The KCL constructors return an
+	// error if it is set with any other FailurePolicy, rather than halting on or skipping the records it is there for.
+	DeadLetterSink DeadLetterSink
+	// Appends dead letters to this file as JSON lines when set in the properties file
+	DeadLetterFileName string
+	// Drops records that have been processed already, nil processes every record delivered
+	Deduplicator *Deduplicator
+	// When set in the properties file (with dedupCapacity) the keys of processed records are kept here too, so
+	// they are still known after a restart
+	DedupFileName string
 }
 
 // Implements the config interface to parse from a java properties file
@@ -60,6 +92,108 @@ func (cfg *KCLConfig) Parse(propertiesFile string) error {
 	}
 	cfg.CheckPointFreqSeconds = checkFreq
 
+	maxMessage := p.GetDefault("maxMessageBytes", "67108864")
+	maxVal, err := strconv.Atoi(maxMessage)
+	if err != nil {
+		return err
+	}
+	cfg.MaxMessageBytes = maxVal
+
+	streaming := p.GetDefault("streamingDecode", "false")
+	streamVal, err := strconv.ParseBool(streaming)
+	if err != nil {
+		return err
+	}
+	cfg.StreamingDecode = streamVal
+
+	workers := p.GetDefault("processingWorkers", "1")
+	workersVal, err := strconv.Atoi(workers)
+	if err != nil {
+		return err
+	}
+	cfg.ProcessingWorkers = workersVal
+
+	deaggregation := p.GetDefault("disableDeaggregation", "false")
+	deaggregationVal, err := strconv.ParseBool(deaggregation)
+	if err != nil {
+		return err
+	}
+	cfg.DisableDeaggregation = deaggregationVal
+
+	encoding, err := ParseContentEncoding(p.GetDefault("contentEncoding", "none"))
+	if err != nil {
+		return err
+	}
+	cfg.ContentEncoding = encoding
+
+	maxDecoded := p.GetDefault("maxDecodedBytes", strconv.Itoa(DefaultMaxDecodedBytes))
+	maxDecodedVal, err := strconv.ParseInt(maxDecoded, 10, 64)
+	if err != nil {
+		return err
+	}
+	cfg.MaxDecodedBytes = maxDecodedVal
+
+	retryAttempts := p.GetDefault("recordRetryMaxAttempts", "1")
+	retryAttemptsVal, err := strconv.Atoi(retryAttempts)
+	if err != nil {
+		return err
+	}
+	cfg.RecordRetry.MaxAttempts = retryAttemptsVal
+
+	retryBase := p.GetDefault("recordRetryBaseDelayMillis", "100")
+	retryBaseVal, err := strconv.Atoi(retryBase)
+	if err != nil {
+		return err
+	}
+	cfg.RecordRetry.BaseDelay = time.Duration(retryBaseVal) * time.Millisecond
+
+	retryMax := p.GetDefault("recordRetryMaxDelayMillis", "10000")
+	retryMaxVal, err := strconv.Atoi(retryMax)
+	if err != nil {
+		return err
+	}
+	cfg.RecordRetry.MaxDelay = time.Duration(retryMaxVal) * time.Millisecond
+
+	retryJitter := p.GetDefault("recordRetryJitter", "0.2")
+	retryJitterVal, err := strconv.ParseFloat(retryJitter, 64)
+	if err != nil {
+		return err
+	}
+	cfg.RecordRetry.Jitter = retryJitterVal
+
+	recordTimeout := p.GetDefault("recordTimeoutMillis", "0")
+	recordTimeoutVal, err := strconv.Atoi(recordTimeout)
+	if err != nil {
+		return err
+	}
+	cfg.RecordTimeout = time.Duration(recordTimeoutVal) * time.Millisecond
+
+	cfg.DeadLetterFileName = p.GetDefault("deadLetterFileName", "")
+
+	dedupCapacity := p.GetDefault("dedupCapacity", "0")
+	dedupCapacityVal, err := strconv.Atoi(dedupCapacity)
+	if err != nil {
+		return err
+	}
+	cfg.DedupFileName = p.GetDefault("dedupFileName", "")
+	if cfg.DedupFileName != "" && dedupCapacityVal <= 0 {
+		// it would be ignored, leaving records to be processed again after a restart when they look deduplicated
+		return fmt.Errorf("kclgo: dedupFileName (%s) needs a dedupCapacity greater than 0", cfg.DedupFileName)
+	}
+	// dead lettering is the obvious choice once there is somewhere to send the dead letters
+	defaultPolicy := FailurePolicyHalt
+	if cfg.DeadLetterFileName != "" {
+		defaultPolicy = FailurePolicyDeadLetter
+	}
+	policy, err := ParseFailurePolicy(p.GetDefault("failurePolicy", defaultPolicy.String()))
+	if err != nil {
+		return err
+	}
+	if cfg.DeadLetterFileName != "" && policy != FailurePolicyDeadLetter {
+		return fmt.Errorf("kclgo: deadLetterFileName (%s) is only used with the deadLetter failure policy, not (%s)", cfg.DeadLetterFileName, policy)
+	}
+	cfg.FailurePolicy = policy
+
 	// default loggers, if you want to use your own logger, add them to your own config object
 
 	cfg.OutLoggerFileName = p.GetDefault("outLoggerFileName", "")
@@ -86,6 +220,27 @@ func (cfg *KCLConfig) Parse(propertiesFile string) error {
 		cfg.ErrLogger = log.New(f, "KCLgo/", log.LstdFlags)
 	}
 
+	// opened last so they aren't left open when another property doesn't parse
+	var sink *FileDeadLetterSink
+	if cfg.DeadLetterFileName != "" {
+		if sink, err = NewFileDeadLetterSink(cfg.DeadLetterFileName); err != nil {
+			return err
+		}
+		cfg.DeadLetterSink = sink
+	}
+	if dedupCapacityVal > 0 {
+		var store DedupStore = NewLRUDedupStore(dedupCapacityVal)
+		if cfg.DedupFileName != "" {
+			if store, err = NewFileDedupStore(cfg.DedupFileName, dedupCapacityVal); err != nil {
+				if sink != nil {
+					sink.Close()
+				}
+				return err
+			}
+		}
+		cfg.Deduplicator = NewDeduplicator(store, nil)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,59 @@
+package kclgo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseOpensFilesLast(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties string
+	}{
+		{name: "failure policy", properties: "failurePolicy = sometimes\n"},
+		{name: "dead letter file unused", properties: "failurePolicy = skip\n"},
+		{name: "out logger", properties: "outLoggerFileName = {dir}/missing/out.log\n"},
+		{name: "err logger", properties: "errLoggerFileName = {dir}/missing/err.log\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			deadLetters := filepath.Join(dir, "dead_letters")
+			dedup := filepath.Join(dir, "dedup")
+			properties := "deadLetterFileName = " + deadLetters + "\ndedupFileName = " + dedup + "\ndedupCapacity = 10\n" +
+				strings.ReplaceAll(tt.properties, "{dir}", dir)
+			propertiesFile := filepath.Join(dir, "kcl.properties")
+			if err := os.WriteFile(propertiesFile, []byte(properties), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := NewConfigFromPropsFile(propertiesFile); err == nil {
+				t.Fatalf("%q parsed without an error", properties)
+			}
+			for _, fileName := range []string{deadLetters, dedup} {
+				if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+					t.Errorf("(%s) was opened before the properties failed to parse", filepath.Base(fileName))
+				}
+			}
+		})
+	}
+}
+
+func TestParseDeadLetterFile(t *testing.T) {
+	dir := t.TempDir()
+	propertiesFile := filepath.Join(dir, "kcl.properties")
+	if err := os.WriteFile(propertiesFile, []byte("deadLetterFileName = "+filepath.Join(dir, "dead_letters")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewConfigFromPropsFile(propertiesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.DeadLetterSink.(*FileDeadLetterSink).Close()
+	if cfg.FailurePolicy != FailurePolicyDeadLetter {
+		t.Errorf("failure policy (%s) with a dead letter file, want deadLetter", cfg.FailurePolicy)
+	}
+}
@@ -0,0 +1,178 @@
+package kclgo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ContentEncoding is how record payloads are compressed by the producers
+type ContentEncoding string
+
+const (
+	// Payloads are handed over as they were put on the stream
+	ContentEncodingNone ContentEncoding = "none"
+	// Each payload is checked for the magic bytes of the encodings below and decompressed if one matches, anything
+	// else is handed over as is
+	ContentEncodingAuto   ContentEncoding = "auto"
+	ContentEncodingGzip   ContentEncoding = "gzip"
+	ContentEncodingZlib   ContentEncoding = "zlib"
+	ContentEncodingZstd   ContentEncoding = "zstd"
+	ContentEncodingSnappy ContentEncoding = "snappy"
+)
+
+// Used when KCLConfig.MaxDecodedBytes isn't set
+const DefaultMaxDecodedBytes = 64 * 1024 * 1024
+
+// A payload decompressed to more than KCLConfig.MaxDecodedBytes, most likely a decompression bomb
+var ErrDecodedTooLarge = errors.New("kclgo: decompressed payload exceeds the maximum size")
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// the stream identifier chunk every snappy framed stream starts with
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// Parses the names used in the properties file, an empty name is ContentEncodingNone
+func ParseContentEncoding(name string) (ContentEncoding, error) {
+	switch e := ContentEncoding(name); e {
+	case "":
+		return ContentEncodingNone, nil
+	case ContentEncodingNone, ContentEncodingAuto, ContentEncodingGzip, ContentEncodingZlib, ContentEncodingZstd, ContentEncodingSnappy:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown content encoding (%s)", name)
+	}
+}
+
+// Works out the encoding of a payload from its first few bytes, ContentEncodingNone if nothing matches
+func SniffContentEncoding(data []byte) ContentEncoding {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return ContentEncodingGzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return ContentEncodingZstd
+	case bytes.HasPrefix(data, snappyMagic):
+		return ContentEncodingSnappy
+	case isZlibHeader(data):
+		return ContentEncodingZlib
+	default:
+		return ContentEncodingNone
+	}
+}
+
+// Only the headers zlib itself writes (deflate with a 32K window at each compression level) are recognised, the
+// two byte checksum alone would match plenty of plain text. Even so 0x78 0x5e is "x^", so ContentDecoder.Decode hands
+// over a payload it sniffed as zlib as is when it doesn't decode.
+func isZlibHeader(data []byte) bool {
+	if len(data) < 2 || data[0] != 0x78 {
+		return false
+	}
+	switch data[1] {
+	case 0x01, 0x5e, 0x9c, 0xda:
+		return true
+	default:
+		return false
+	}
+}
+
+// ContentDecoder decompresses record payloads, see Record.BinaryData
+type ContentDecoder struct {
+	Encoding ContentEncoding
+	// Payloads that decompress to more than this fail with ErrDecodedTooLarge
+	MaxSize int64
+}
+
+func (c *ContentDecoder) Decode(data []byte) ([]byte, error) {
+	if c.Encoding != ContentEncodingAuto {
+		return c.decode(c.Encoding, data)
+	}
+	encoding := SniffContentEncoding(data)
+	decoded, err := c.decode(encoding, data)
+	if err != nil && encoding == ContentEncodingZlib && !errors.Is(err, ErrDecodedTooLarge) {
+		// the zlib header is only two bytes, it was most likely text that happened to start with them
+		return data, nil
+	}
+	return decoded, err
+}
+
+func (c *ContentDecoder) decode(encoding ContentEncoding, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case ContentEncodingNone, "":
+		return data, nil
+	case ContentEncodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case ContentEncodingZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case ContentEncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxMemory(c.maxSize())))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case ContentEncodingSnappy:
+		r = snappy.NewReader(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("kclgo: unknown content encoding (%s)", encoding)
+	}
+
+	// read one byte past the limit so a payload of exactly the limit isn't mistaken for a bomb
+	decoded, err := io.ReadAll(io.LimitReader(r, c.maxSize()+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		return nil, ErrDecodedTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kclgo: could not decode %s payload: %w", encoding, err)
+	}
+	if int64(len(decoded)) > c.maxSize() {
+		return nil, ErrDecodedTooLarge
+	}
+	return decoded, nil
+}
+
+func (c *ContentDecoder) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return DefaultMaxDecodedBytes
+	}
+	return c.MaxSize
+}
+
+// zstd frames declare a window of at least 1KB, rounded up from the size of what they hold. Limiting the window to
+// the decoded size itself would fail payloads of exactly that size, the decoded size is checked afterwards anyway.
+func zstdMaxMemory(maxSize int64) uint64 {
+	window := uint64(1 << 10)
+	for window < uint64(maxSize) {
+		window <<= 1
+	}
+	return window
+}
+
+// nil unless the config asks for payloads to be decoded
+func newContentDecoder(config *KCLConfig) *ContentDecoder {
+	if config.ContentEncoding == "" || config.ContentEncoding == ContentEncodingNone {
+		return nil
+	}
+	c := new(ContentDecoder)
+	c.Encoding = config.ContentEncoding
+	c.MaxSize = config.MaxDecodedBytes
+	return c
+}
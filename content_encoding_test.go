@@ -0,0 +1,140 @@
+package kclgo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func compress(t *testing.T, encoding ContentEncoding, level int, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch encoding {
+	case ContentEncodingGzip:
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(data); err == nil {
+			err = w.Close()
+		}
+	case ContentEncodingZlib:
+		var w *zlib.Writer
+		if w, err = zlib.NewWriterLevel(&buf, level); err == nil {
+			if _, err = w.Write(data); err == nil {
+				err = w.Close()
+			}
+		}
+	case ContentEncodingZstd:
+		var w *zstd.Encoder
+		if w, err = zstd.NewWriter(nil); err == nil {
+			buf.Write(w.EncodeAll(data, nil))
+			err = w.Close()
+		}
+	case ContentEncodingSnappy:
+		w := snappy.NewBufferedWriter(&buf)
+		if _, err = w.Write(data); err == nil {
+			err = w.Close()
+		}
+	default:
+		t.Fatalf("can't compress with (%s)", encoding)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffContentEncoding(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	tests := []struct {
+		name string
+		data []byte
+		want ContentEncoding
+	}{
+		{name: "gzip", data: compress(t, ContentEncodingGzip, 0, data), want: ContentEncodingGzip},
+		{name: "zstd", data: compress(t, ContentEncodingZstd, 0, data), want: ContentEncodingZstd},
+		{name: "snappy", data: compress(t, ContentEncodingSnappy, 0, data), want: ContentEncodingSnappy},
+		{name: "zlib fastest", data: compress(t, ContentEncodingZlib, zlib.BestSpeed, data), want: ContentEncodingZlib},
+		{name: "zlib fast", data: compress(t, ContentEncodingZlib, 3, data), want: ContentEncodingZlib},
+		{name: "zlib default", data: compress(t, ContentEncodingZlib, zlib.DefaultCompression, data), want: ContentEncodingZlib},
+		{name: "zlib best", data: compress(t, ContentEncodingZlib, zlib.BestCompression, data), want: ContentEncodingZlib},
+		{name: "text", data: data, want: ContentEncodingNone},
+		{name: "json", data: []byte(`{"x":1}`), want: ContentEncodingNone},
+		// a zlib checksum, but not a header zlib writes
+		{name: "x then a checksum", data: []byte("xW"), want: ContentEncodingNone},
+		{name: "empty", want: ContentEncodingNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffContentEncoding(tt.data); got != tt.want {
+				t.Errorf("SniffContentEncoding() = (%s), want (%s)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeAuto(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	tests := []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "gzip", data: compress(t, ContentEncodingGzip, 0, data), want: data},
+		{name: "zstd", data: compress(t, ContentEncodingZstd, 0, data), want: data},
+		{name: "snappy", data: compress(t, ContentEncodingSnappy, 0, data), want: data},
+		{name: "zlib", data: compress(t, ContentEncodingZlib, 3, data), want: data},
+		{name: "plain", data: data, want: data},
+		// sniffed as zlib but it doesn't decode, so it's handed over as is
+		{name: "text that looks like zlib", data: []byte("x^2 + y^2 = r^2"), want: []byte("x^2 + y^2 = r^2")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ContentDecoder{Encoding: ContentEncodingAuto}
+			got, err := c.Decode(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decode() = (%q), want (%q)", got, tt.want)
+			}
+		})
+	}
+
+	// only guessing lets text through, a zlib payload that doesn't decode is an error when the encoding is known
+	c := &ContentDecoder{Encoding: ContentEncodingZlib}
+	if _, err := c.Decode([]byte("x^2 + y^2 = r^2")); err == nil {
+		t.Error("Decode() with the zlib encoding handed over text")
+	}
+}
+
+func TestDecodeMaxSize(t *testing.T) {
+	const max = 1000
+	for _, encoding := range []ContentEncoding{ContentEncodingGzip, ContentEncodingZlib, ContentEncodingZstd, ContentEncodingSnappy} {
+		for _, auto := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s auto %v", encoding, auto), func(t *testing.T) {
+				c := &ContentDecoder{Encoding: encoding, MaxSize: max}
+				if auto {
+					c.Encoding = ContentEncodingAuto
+				}
+
+				atMax := bytes.Repeat([]byte("a"), max)
+				got, err := c.Decode(compress(t, encoding, zlib.DefaultCompression, atMax))
+				if err != nil || !bytes.Equal(got, atMax) {
+					t.Errorf("Decode() of exactly MaxSize = (%d bytes, %v)", len(got), err)
+				}
+				overMax := append(atMax, 'a')
+				if _, err := c.Decode(compress(t, encoding, zlib.DefaultCompression, overMax)); !errors.Is(err, ErrDecodedTooLarge) {
+					t.Errorf("Decode() of MaxSize+1 returned (%v), want ErrDecodedTooLarge", err)
+				}
+			})
+		}
+	}
+}
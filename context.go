@@ -0,0 +1,37 @@
+package kclgo
+
+import "context"
+
+type shardContextKey struct{}
+type recordContextKey struct{}
+
+func contextWithShard(ctx context.Context, shard ShardContext) context.Context {
+	return context.WithValue(ctx, shardContextKey{}, shard)
+}
+
+func contextWithRecord(ctx context.Context, meta RecordMeta) context.Context {
+	return context.WithValue(ctx, recordContextKey{}, meta)
+}
+
+// The shard the records being processed with ctx came from
+func ShardFromContext(ctx context.Context) (ShardContext, bool) {
+	shard, ok := ctx.Value(shardContextKey{}).(ShardContext)
+	return shard, ok
+}
+
+// The record being processed with ctx, only set for a single record (e.g. in a ContextRecordProcessingFunc)
+func RecordFromContext(ctx context.Context) (RecordMeta, bool) {
+	meta, ok := ctx.Value(recordContextKey{}).(RecordMeta)
+	return meta, ok
+}
+
+// ContextRecordFunc adapts a plain function to a ContextRecordProcessingFunc
+type ContextRecordFunc func(context.Context, Record) error
+
+func (f ContextRecordFunc) ProcessRecord(record Record) error {
+	return f(context.Background(), record)
+}
+
+func (f ContextRecordFunc) ProcessRecordContext(ctx context.Context, record Record) error {
+	return f(ctx, record)
+}
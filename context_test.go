@@ -0,0 +1,32 @@
+package kclgo
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKCLRunCancelsProcessingAfterTheFinalAction(t *testing.T) {
+	var ctxs []context.Context
+	k, err := NewDefaultKCL(testConfig(), ContextRecordFunc(func(ctx context.Context, record Record) error {
+		if ctx.Err() != nil {
+			t.Errorf("record (%s) processed with a cancelled context", record.SequenceNumber)
+		}
+		if shard, ok := ShardFromContext(ctx); !ok || shard.ShardID != "shardId-000000000001" || shard.MillisBehindLatest != 7 {
+			t.Errorf("record (%s) processed with shard (%+v)", record.SequenceNumber, shard)
+		}
+		ctxs = append(ctxs, ctx)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := mustMarshal(&ProcessRecordsInput{Action: "processRecords", MillisBehindLatest: 7, Records: []Record{testRecord("1", "a")}})
+	d := &fakeDaemon{messages: []string{initializeLine, line, shardEndedLine}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxs) != 1 || ctxs[0].Err() == nil {
+		t.Fatal("the context records were processed with wasn't cancelled once Run returned")
+	}
+}
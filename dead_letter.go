@@ -0,0 +1,78 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ DeadLetterSink = (*FileDeadLetterSink)(nil)
+var _ io.Closer = (*FileDeadLetterSink)(nil)
+
+// DeadLetter is a record the DefaultRecordProcessor gave up on
+type DeadLetter struct {
+	Record  Record `json:"record"`
+	ShardID string `json:"shardId"`
+	// The messages of the error chain, outermost first
+	Errors   []string  `json:"errors"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+func newDeadLetter(shardID string, record Record, err error) DeadLetter {
+	letter := DeadLetter{
+		Record:   record,
+		ShardID:  shardID,
+		Attempts: 1,
+		Time:     time.Now().UTC(),
+	}
+	var retryErr *RetryError
+	if errors.As(err, &retryErr) {
+		letter.Attempts = retryErr.Attempts
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		letter.Errors = append(letter.Errors, err.Error())
+	}
+	return letter
+}
+
+// FileDeadLetterSink appends dead letters to a local file, one JSON object per line
+type FileDeadLetterSink struct {
+	mux  sync.Mutex
+	file *os.File
+}
+
+func (s *FileDeadLetterSink) WriteDeadLetter(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	// the record is checkpointed past once this returns, so make sure it is on disk
+	return s.file.Sync()
+}
+
+func (s *FileDeadLetterSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.file.Close()
+}
+
+func NewFileDeadLetterSink(fileName string) (*FileDeadLetterSink, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s := new(FileDeadLetterSink)
+	s.file = f
+	return s, nil
+}
@@ -3,49 +3,198 @@ package kclgo
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 )
 
-// I don't want to json parse the whole message twice (could be a very long line and very slow)
-// so I'm counting on the java code to put the action as the first token (as is the case in the code)
-// so I'm just slurping in up to the first comma and returning the action
-func slurpToFirstComma(message *string) (string, error) {
-	var i int
-	for index, runeValue := range *message {
-		if runeValue == ',' {
-			i = index
-			break
-		}
-	}
-	t := make([]byte, i, i)
-	// copy stops early upon reaching the capacity of src or dest.
-	copy(t, *message)
-	t = append(t, '}')
-
-	act := struct {
-		Action string `json:"action"`
-	}{}
-	if err := json.Unmarshal(t, &act); err != nil {
+var (
+	actionsMux sync.RWMutex
+	actions    = map[string]func() ActionInterface{
+		"initialize":        func() ActionInterface { return &InitializeInput{} },
+		"processRecords":    func() ActionInterface { return &ProcessRecordsInput{} },
+		"shutdown":          func() ActionInterface { return &ShutdownInput{} },
+		"checkpoint":        func() ActionInterface { return &checkPointResponse{} },
+		"shutdownRequested": func() ActionInterface { return &ShutdownRequestedInput{} },
+		"leaseLost":         func() ActionInterface { return &LeaseLostInput{} },
+		"shardEnded":        func() ActionInterface { return &ShardEndedInput{} },
+	}
+)
+
+// RegisterAction teaches kclgo a new action from the MultiLangDaemon without forking the decoder. Messages with this
+// action are unmarshalled into the value newInput returns, its Perform is called with the RecordProcessor and the
+// message is acked like any other. Registering an action that already exists replaces it.
+func RegisterAction(action string, newInput func() ActionInterface) {
+	actionsMux.Lock()
+	defer actionsMux.Unlock()
+	actions[action] = newInput
+}
+
+func newAction(action string) (ActionInterface, error) {
+	actionsMux.RLock()
+	newInput, there := actions[action]
+	actionsMux.RUnlock()
+
+	if !there {
+		return nil, MalformedAction(fmt.Errorf("Action (%s) not mapped in kclgo ", action))
+	}
+	return newInput(), nil
+}
+
+// I don't want to json parse the whole message twice (could be a very long line and very slow) so this scans for the
+// top level "action" key and only decodes its value. Everything else is skipped over without being decoded, nested
+// objects included, so the "action" of a KCL 2.x record can't be mistaken for the message's.
+func sniffAction(message string) (string, error) {
+	s := actionScanner{data: message}
+	s.skipSpace()
+	if !s.consume('{') {
+		return "", s.malformed("expected the message to be an object")
+	}
+
+	for {
+		s.skipSpace()
+		if s.consume('}') {
+			return "", s.malformed("no action in message")
+		}
+		key, err := s.readString()
+		if err != nil {
+			return "", err
+		}
+		s.skipSpace()
+		if !s.consume(':') {
+			return "", s.malformed("expected a colon after the key")
+		}
+		s.skipSpace()
+
+		if key == "action" {
+			action, err := s.readString()
+			if err != nil {
+				return "", err
+			}
+			return action, nil
+		}
+		if err := s.skipValue(); err != nil {
+			return "", err
+		}
+
+		s.skipSpace()
+		if s.consume(',') {
+			continue
+		}
+		if s.consume('}') {
+			return "", s.malformed("no action in message")
+		}
+		return "", s.malformed("expected a comma between values")
+	}
+}
+
+type actionScanner struct {
+	data string
+	pos  int
+}
+
+func (s *actionScanner) malformed(reason string) error {
+	return MalformedAction(fmt.Errorf("%s (at offset %d)", reason, s.pos))
+}
+
+func (s *actionScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *actionScanner) consume(c byte) bool {
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// Returns the end of the string starting at pos (just past the closing quote)
+func (s *actionScanner) stringEnd() (int, error) {
+	if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+		return 0, s.malformed("expected a string")
+	}
+	for i := s.pos + 1; i < len(s.data); i++ {
+		switch s.data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, s.malformed("unterminated string")
+}
+
+func (s *actionScanner) readString() (string, error) {
+	end, err := s.stringEnd()
+	if err != nil {
+		return "", err
+	}
+	raw := s.data[s.pos:end]
+	s.pos = end
+	if !strings.ContainsRune(raw, '\\') {
+		return raw[1 : len(raw)-1], nil
+	}
+	var str string
+	if err := json.Unmarshal([]byte(raw), &str); err != nil {
 		return "", MalformedAction(err)
 	}
-	return act.Action, nil
+	return str, nil
+}
+
+// Skips a single value of any type, strings are stepped over whole so brackets and commas in them don't count
+func (s *actionScanner) skipValue() error {
+	depth := 0
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			end, err := s.stringEnd()
+			if err != nil {
+				return err
+			}
+			s.pos = end
+		case c == '{' || c == '[':
+			depth++
+			s.pos++
+		case c == '}' || c == ']':
+			if depth == 0 {
+				// closes the enclosing object, the value was a number or a literal
+				return nil
+			}
+			depth--
+			s.pos++
+		case c == ',' && depth == 0:
+			return nil
+		default:
+			s.pos++
+		}
+
+		if depth == 0 && (c == '"' || c == '}' || c == ']') {
+			return nil
+		}
+	}
+	if depth != 0 {
+		return s.malformed("unterminated value")
+	}
+	return nil
 }
 
 func decodeMessage(message *string) (ActionInterface, error) {
-	action, err := slurpToFirstComma(message)
+	action, err := sniffAction(*message)
 	if err != nil {
 		return nil, err
 	}
 
-	actions := make(map[string]ActionInterface)
-	actions["initialize"] = &InitializeInput{}
-	actions["processRecords"] = &ProcessRecordsInput{}
-	actions["shutdown"] = &ShutdownInput{}
-	actions["checkpoint"] = &checkPointResponse{}
-	actions["shutdownRequested"] = &ShutdownRequestedInput{}
-
-	msgInput, there := actions[action]
-	if !there {
-		return nil, MalformedAction(fmt.Errorf("Action (%s) not mapped in kclgo ", action))
+	msgInput, err := newAction(action)
+	if err != nil {
+		return nil, err
 	}
 
 	if err := json.Unmarshal([]byte(*message), msgInput); err != nil {
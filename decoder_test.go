@@ -0,0 +1,60 @@
+package kclgo
+
+import "testing"
+
+func TestSniffAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+		wantErr bool
+	}{
+		{name: "first key", message: `{"action":"initialize","shardId":"shardId-000000000001"}`, want: "initialize"},
+		{name: "spaces", message: " { \"action\" :\t\"shardEnded\" }\n", want: "shardEnded"},
+		{
+			// KCL 2.x records carry an action of their own
+			name:    "after nested actions",
+			message: `{"millisBehindLatest":0,"records":[{"action":"record","data":"e30="},{"action":"record","data":"e30="}],"action":"processRecords"}`,
+			want:    "processRecords",
+		},
+		{
+			name:    "brackets and quotes in strings",
+			message: `{"data":"}]{[\",\"action\":\"nope","action":"shutdown","reason":"TERMINATE"}`,
+			want:    "shutdown",
+		},
+		{name: "literals and numbers", message: `{"n":-1.5e3,"ok":true,"none":null,"action":"leaseLost"}`, want: "leaseLost"},
+		{name: "escaped value", message: `{"action":"lease\u004cost"}`, want: "leaseLost"},
+		{name: "not an object", message: `["action","initialize"]`, wantErr: true},
+		{name: "no action", message: `{"shardId":"shardId-000000000001"}`, wantErr: true},
+		{name: "empty object", message: `{}`, wantErr: true},
+		{name: "action isn't a string", message: `{"action":3}`, wantErr: true},
+		{name: "unterminated string", message: `{"shardId":"shardId-0000`, wantErr: true},
+		{name: "unterminated value", message: `{"records":[{"action":"record"}`, wantErr: true},
+		{name: "missing colon", message: `{"action" "initialize"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sniffAction(tt.message)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sniffAction() = (%s), want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sniffAction() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sniffAction() = (%s), want (%s)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageUnknownAction(t *testing.T) {
+	message := `{"action":"nope"}`
+	if _, err := decodeMessage(&message); err == nil {
+		t.Fatal("decoded a message with an unknown action")
+	}
+}
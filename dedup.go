@@ -0,0 +1,270 @@
+package kclgo
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var _ DedupStore = (*LRUDedupStore)(nil)
+var _ io.Closer = (*LRUDedupStore)(nil)
+
+// DedupStore remembers the keys of records that have been processed
+type DedupStore interface {
+	Contains(key string) (bool, error)
+	Add(key string) error
+}
+
+// LRUDedupStore keeps the most recently added keys up to a fixed number, optionally in a file as well so they
+// survive the process being restarted. The file isn't synced as keys are added, see NewFileDedupStore.
+type LRUDedupStore struct {
+	mux      sync.Mutex
+	capacity int
+	keys     map[string]*list.Element
+	order    *list.List
+
+	// appended to as keys are added, rewritten with just the keys held once it has grown to twice the capacity
+	file     *os.File
+	fileName string
+	appended int
+}
+
+func (s *LRUDedupStore) Contains(key string) (bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, there := s.keys[key]
+	return there, nil
+}
+
+func (s *LRUDedupStore) Add(key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.add(key) || s.file == nil {
+		return nil
+	}
+	if s.appended >= s.capacity {
+		return s.compact()
+	}
+	if _, err := s.file.WriteString(strconv.Quote(key) + "\n"); err != nil {
+		return err
+	}
+	s.appended++
+	return nil
+}
+
+// Reports whether the key is new
+func (s *LRUDedupStore) add(key string) bool {
+	if e, there := s.keys[key]; there {
+		s.order.MoveToFront(e)
+		return false
+	}
+	s.keys[key] = s.order.PushFront(key)
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.keys, oldest.Value.(string))
+	}
+	return true
+}
+
+// Rewrites the file with the keys held, oldest first so loading it again keeps the same order
+func (s *LRUDedupStore) compact() error {
+	tmpName := s.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		w.WriteString(strconv.Quote(e.Value.(string)) + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, s.fileName); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	s.appended = 0
+	return nil
+}
+
+func (s *LRUDedupStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Keeps up to capacity keys in memory
+func NewLRUDedupStore(capacity int) *LRUDedupStore {
+	s := new(LRUDedupStore)
+	s.capacity = capacity
+	if s.capacity < 1 {
+		s.capacity = 1
+	}
+	s.keys = make(map[string]*list.Element)
+	s.order = list.New()
+	return s
+}
+
+// Keeps up to capacity keys in memory and in fileName, loading any that are already there. Keys aren't synced to
+// disk as they are added, so a crash of the whole machine can still lose the last few.
+func NewFileDedupStore(fileName string, capacity int) (*LRUDedupStore, error) {
+	s := NewLRUDedupStore(capacity)
+	s.fileName = fileName
+
+	if f, err := os.Open(fileName); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, err := strconv.Unquote(scanner.Text())
+			if err != nil {
+				// most likely the last line of a crash, the keys before it are still good
+				continue
+			}
+			s.add(key)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// start from a compacted file so it never holds more than twice the capacity
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	if err := s.compact(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Deduplicator drops records that have already been processed, e.g. when a shard is read again from its last
+// checkpoint after a failover or a crash. Records are keyed on the shard and their sequence and sub-sequence
+// numbers unless given a key func.
+type Deduplicator struct {
+	store DedupStore
+	key   func(Record) string
+	// duplicates dropped
+	dropped int64
+}
+
+// Duplicates dropped so far
+func (d *Deduplicator) Dropped() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// The key the record is remembered by, empty if it shouldn't be deduplicated. Sequence numbers are only unique
+// within a shard, so without a key func ctx has to carry the shard.
+func (d *Deduplicator) keyFor(ctx context.Context, record Record) (string, error) {
+	if d.key != nil {
+		return d.key(record), nil
+	}
+	shard, ok := ShardFromContext(ctx)
+	if !ok || shard.ShardID == "" {
+		return "", fmt.Errorf("kclgo: can't deduplicate record (%s) without the shard it came from", record.SequenceNumber)
+	}
+	return shard.ShardID + "/" + record.SequenceNumber.String(), nil
+}
+
+// Reports whether the record has been processed already, counting it as dropped if it has
+func (d *Deduplicator) seen(ctx context.Context, record Record) (bool, error) {
+	key, err := d.keyFor(ctx, record)
+	if err != nil || key == "" {
+		return false, err
+	}
+	there, err := d.store.Contains(key)
+	if err != nil {
+		return false, fmt.Errorf("kclgo: could not check record (%s) for duplicates: %w", record.SequenceNumber, err)
+	}
+	if there {
+		atomic.AddInt64(&d.dropped, 1)
+	}
+	return there, nil
+}
+
+func (d *Deduplicator) processed(ctx context.Context, record Record) error {
+	key, err := d.keyFor(ctx, record)
+	if err != nil || key == "" {
+		return err
+	}
+	if err := d.store.Add(key); err != nil {
+		return fmt.Errorf("kclgo: could not remember record (%s) as processed: %w", record.SequenceNumber, err)
+	}
+	return nil
+}
+
+// Remembers a record that has been processed successfully. Failing to is only logged, failing the record instead
+// would have it retried (or halt the shard) when it is already done with.
+func (d *Deduplicator) remember(ctx context.Context, record Record, logger LoggerInterface) {
+	if err := d.processed(ctx, record); err != nil {
+		logger.Printf("Error (%s), it will be processed again if it is delivered again\n", err.Error())
+	}
+}
+
+// Skips records that have been processed already, and remembers the ones next processes successfully. The
+// DefaultRecordProcessor wraps it around any middleware of your own, so they never see a duplicate. Records that
+// can't be remembered are logged with the standard logger.
+func (d *Deduplicator) Middleware() Middleware {
+	return d.middleware(log.Default())
+}
+
+func (d *Deduplicator) middleware(logger LoggerInterface) Middleware {
+	return func(next RecordProcessingFunc) RecordProcessingFunc {
+		return WrapProcessingFunc(next, func(ctx context.Context, record Record) error {
+			seen, err := d.seen(ctx, record)
+			if err != nil || seen {
+				return err
+			}
+			if err := CallProcessingFunc(ctx, next, record); err != nil {
+				return err
+			}
+			d.remember(ctx, record, logger)
+			return nil
+		})
+	}
+}
+
+// Closes the store if it is an io.Closer, KCL.Run does this when it returns
+func (d *Deduplicator) Close() error {
+	if c, ok := d.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// key is optional, it gives the idempotency key of a record (e.g. an ID from its payload) in place of its shard and
+// sequence numbers. Records it gives an empty key for are always processed.
+func NewDeduplicator(store DedupStore, key func(Record) string) *Deduplicator {
+	d := new(Deduplicator)
+	d.store = store
+	d.key = key
+	return d
+}
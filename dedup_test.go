@@ -0,0 +1,181 @@
+package kclgo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeduplicatorRunsOutsideMiddleware(t *testing.T) {
+	config := testConfig()
+	config.Deduplicator = NewDeduplicator(NewLRUDedupStore(10), nil)
+	metrics := new(ProcessingMetrics)
+	calls := 0
+	k, err := NewDefaultKCL(config, RecordFunc(func(Record) error {
+		calls++
+		return nil
+	}), MetricsMiddleware(metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the daemon delivers the batch again, e.g. after a failover
+	batch := processRecordsLine(testRecord("1", "a"), testRecord("2", "b"))
+	d := &fakeDaemon{messages: []string{initializeLine, batch, batch, shardEndedLine}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("func called (%d) times, want (2)", calls)
+	}
+	if metrics.Processed() != 2 {
+		t.Errorf("middleware saw (%d) records, want (2)", metrics.Processed())
+	}
+	if config.Deduplicator.Dropped() != 2 {
+		t.Errorf("dropped (%d) duplicates, want (2)", config.Deduplicator.Dropped())
+	}
+}
+
+// failingStore never has a key and can't add one, e.g. a file store on a full disk
+type failingStore struct{}
+
+func (failingStore) Contains(string) (bool, error) { return false, nil }
+
+func (failingStore) Add(string) error { return errors.New("disk full") }
+
+func TestDeduplicatorStoreFailsAfterProcessing(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch bool
+	}{
+		{name: "record func"},
+		{name: "batch func", batch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Deduplicator = NewDeduplicator(failingStore{}, nil)
+			config.RecordRetry = RetryPolicy{MaxAttempts: 3}
+
+			calls := 0
+			var k *KCL
+			var err error
+			if tt.batch {
+				k, err = NewDefaultBatchKCL(config, batchFunc(func(_ ShardContext, input *ProcessRecordsInput) []error {
+					calls += len(input.Records)
+					return nil
+				}))
+			} else {
+				k, err = NewDefaultKCL(config, RecordFunc(func(Record) error {
+					calls++
+					return nil
+				}))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(testRecord("1", "a"), testRecord("2", "b")), shardEndedLine}}
+			if err := d.run(t, k); err != nil {
+				t.Fatalf("Run returned (%v), the records were processed", err)
+			}
+			// retrying would process them again
+			if calls != 2 {
+				t.Errorf("processed (%d) records, want (2)", calls)
+			}
+			if got := d.checkpointed(); !equalStrings(got, []string{"2", ""}) {
+				t.Errorf("checkpointed at (%v), want [2 ]", got)
+			}
+		})
+	}
+}
+
+func TestDeduplicatorKey(t *testing.T) {
+	record := testRecord("1", "a")
+	withShard := contextWithShard(context.Background(), ShardContext{ShardID: "shardId-000000000001"})
+
+	d := NewDeduplicator(NewLRUDedupStore(10), nil)
+	if _, err := d.seen(context.Background(), record); err == nil {
+		t.Error("deduplicated a record without knowing its shard")
+	}
+	if err := d.processed(withShard, record); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := d.seen(withShard, record); err != nil || !seen {
+		t.Errorf("seen() = (%v, %v) after it was processed", seen, err)
+	}
+	other := contextWithShard(context.Background(), ShardContext{ShardID: "shardId-000000000002"})
+	if seen, err := d.seen(other, record); err != nil || seen {
+		t.Errorf("seen() = (%v, %v) for the same sequence number in another shard", seen, err)
+	}
+
+	// a key func doesn't need the shard
+	d = NewDeduplicator(NewLRUDedupStore(10), func(r Record) string { return r.PartitionKey })
+	if err := d.processed(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := d.seen(context.Background(), testRecord("2", "a")); err != nil || !seen {
+		t.Errorf("seen() = (%v, %v) for a record with the same key", seen, err)
+	}
+}
+
+func TestFileDedupStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dedup")
+	s, err := NewFileDedupStore(fileName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewFileDedupStore(fileName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, want := range map[string]bool{"a": false, "c": false, "d": true, "e": true} {
+		if there, _ := s.Contains(key); there != want {
+			t.Errorf("Contains(%s) = %v after reopening, want %v", key, there, want)
+		}
+	}
+}
+
+func TestParseDedupFileNeedsCapacity(t *testing.T) {
+	tests := []struct {
+		capacity string
+		wantErr  bool
+	}{
+		{capacity: "", wantErr: true},
+		{capacity: "dedupCapacity = 0\n", wantErr: true},
+		{capacity: "dedupCapacity = 10\n"},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		propertiesFile := filepath.Join(dir, "kcl.properties")
+		properties := "dedupFileName = " + filepath.Join(dir, "dedup") + "\n" + tt.capacity
+		if err := os.WriteFile(propertiesFile, []byte(properties), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := NewConfigFromPropsFile(propertiesFile)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q parsed with error (%v), want an error: %v", properties, err, tt.wantErr)
+		}
+		if err == nil {
+			if cfg.Deduplicator == nil {
+				t.Errorf("%q parsed without a Deduplicator", properties)
+			} else {
+				cfg.Deduplicator.Close()
+			}
+		}
+	}
+}
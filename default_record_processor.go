@@ -1,124 +1,522 @@
 package kclgo
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/big"
+	"sync"
 	"time"
 )
 
 var _ RecordProcessor = (*DefaultRecordProcessor)(nil)
+var _ LeaseLostProcessor = (*DefaultRecordProcessor)(nil)
+var _ ShardEndedProcessor = (*DefaultRecordProcessor)(nil)
+var _ CheckPointer = (*DefaultRecordProcessor)(nil)
 
 type DefaultRecordProcessor struct {
 	handler            *IoHandler
 	checkpointer       CheckPointer
 	config             *KCLConfig
-	largestSeq         *big.Int
-	largestSubSeq      int
+	largestSeq         ExtendedSequenceNumber
 	lastCheckpointTime time.Time
 	processingFunc     RecordProcessingFunc
+	batchFunc          BatchProcessingFunc
+	// the processing func checkpoints itself, see CheckPointerAware
+	funcCheckPoints bool
+	// why processing stopped, under FailurePolicyStall or because a batch was cancelled part way through
+	stalled error
+	// from InitializeInput.Context, waiting to retry a checkpoint stops once it is done
+	ctx context.Context
+
+	// held for the whole of a checkpoint, the func may checkpoint from several workers at once
+	checkpointMux sync.Mutex
+	// set while the worker pool is processing a batch for a func that checkpoints itself
+	watermark *watermark
 }
 
 func (k *DefaultRecordProcessor) Initialize(input *InitializeInput) error {
 	k.config.OutLogger.Printf("Processing shard %v\n", input.ShardID)
-	k.largestSeq = &big.Int{}
+	k.ctx = input.Context()
+	k.largestSeq = ExtendedSequenceNumber{}
 	k.lastCheckpointTime = time.Now()
+	k.stalled = nil
 
 	return nil
 }
 
-func (k *DefaultRecordProcessor) shouldUpdateSequence(seq *big.Int, subSeq int) bool {
-	zero := &big.Int{}
-	if seq.Cmp(k.largestSeq) > 0 || (k.largestSeq.Cmp(zero) == 0 && k.largestSubSeq == 0) {
-		return true
+// The shard comes from input.Context(), see ShardFromContext. Once the context is cancelled no more records are
+// handed to the processing func, retries stop and the batch is cut short at the first record that didn't get
+// processed. Nothing is processed or checkpointed after that, as it is only cancelled once the daemon is done with us.
+func (k *DefaultRecordProcessor) ProcessRecords(input *ProcessRecordsInput) error {
+	ctx := input.Context()
+
+	if k.stalled != nil {
+		k.config.ErrLogger.Printf("Stalled after error: (%s), acking (%v) Records without processing them\n", k.stalled.Error(), len(input.Records))
+		return nil
 	}
-	if subSeq > k.largestSubSeq {
-		return true
+	k.config.OutLogger.Printf("Processing (%v) Records (%v) milliseconds behind latest", len(input.Records), input.MillisBehindLatest)
+
+	if !k.config.DisableDeaggregation {
+		input = k.deaggregate(input)
 	}
-	return false
-}
 
-func (k *DefaultRecordProcessor) ProcessRecords(input *ProcessRecordsInput) error {
-	k.config.OutLogger.Printf("Processing (%v) Records (%v) milliseconds behind latest", len(input.Records), input.MillisBehindLatest)
+	seqs := make([]ExtendedSequenceNumber, len(input.Records))
+	for i, r := range input.Records {
+		seq, err := ParseExtendedSequenceNumber(r.SequenceNumber.SequenceNumber, r.SequenceNumber.SubSequenceNumber)
+		if err != nil {
+			return err
+		}
+		seqs[i] = seq
+	}
 
-	var retErr error
-	for _, r := range input.Records {
-		seq := new(big.Int)
-		if _, worked := seq.SetString(r.SequenceNumber, 10); !worked {
-			return fmt.Errorf("could not parse Sequence Number (%s) into big.Int", r.SequenceNumber)
+	var dropped int64
+	if k.config.Deduplicator != nil {
+		dropped = k.config.Deduplicator.Dropped()
+	}
+
+	var errs []error
+	switch {
+	case k.batchFunc != nil:
+		var err error
+		if errs, err = k.processBatchOnce(ctx, input); err != nil {
+			return err
 		}
+	case k.config.ProcessingWorkers > 1:
+		errs = k.processConcurrently(ctx, input.Records, k.config.ProcessingWorkers)
+	default:
+		errs = k.processSerially(ctx, input.Records)
+	}
 
-		if err := k.processingFunc.ProcessRecord(r); err != nil {
+	if k.config.Deduplicator != nil {
+		if n := k.config.Deduplicator.Dropped() - dropped; n > 0 {
+			k.config.OutLogger.Printf("Dropped (%v) duplicate Records\n", n)
+		}
+	}
+
+	// only move up to the first failure, everything after it has to be delivered again
+	var retErr error
+	for i, err := range errs {
+		if err != nil {
 			retErr = err
 			break
 		}
-		if k.shouldUpdateSequence(seq, r.SubSequenceNumber) {
-			k.largestSeq = seq
-			k.largestSubSeq = r.SubSequenceNumber
+		if k.largestSeq.Less(seqs[i]) {
+			k.largestSeq = seqs[i]
 		}
 	}
 
-	if retErr == nil && !time.Now().Before(
-		k.lastCheckpointTime.Add(
-			time.Duration(int64(k.config.CheckPointFreqSeconds))*time.Second)) {
-		k.checkpointer.CheckPoint(k.largestSeq.String(), k.largestSubSeq)
+	stall := retErr != nil && (ctx.Err() != nil || k.config.FailurePolicy == FailurePolicyStall)
+	if stall {
+		if ctx.Err() != nil {
+			retErr = fmt.Errorf("batch cancelled: %w", ctx.Err())
+		}
+		k.stalled = retErr
+		k.config.ErrLogger.Printf("Stalling after error: (%s), no more records will be processed\n", retErr.Error())
+		retErr = nil
+	}
+
+	// when stalling checkpoint what did get processed now, it won't move again
+	due := stall || !time.Now().Before(k.lastCheckpointTime.Add(time.Duration(int64(k.config.CheckPointFreqSeconds))*time.Second))
+	if retErr == nil && !k.funcCheckPoints && !k.largestSeq.IsZero() && due {
+		seq := k.largestSeq
+		_, err := k.CheckPoint(&seq)
+		var mismatch *CheckPointMismatchError
+		switch {
+		case err == nil:
+			k.lastCheckpointTime = time.Now()
+		case errors.As(err, &mismatch):
+			return err
+		}
 	}
 
 	return retErr
 }
 
-func (k *DefaultRecordProcessor) CheckPoint(sequenceNumber string, subSequenceNumber int) error {
-	for i := 0; i < k.config.CheckPointRetries; i++ {
-		if err := k.checkpointer.CheckPoint(sequenceNumber, subSequenceNumber); err != nil {
-			switch err.Error() {
-			case "ShutdownException":
-				k.config.OutLogger.Println("Encountered Shutdown Exception, skipping checkpoint")
-				return err
-			case "ThrottlingException":
-				if k.config.CheckPointRetries < i {
-					k.config.OutLogger.Printf("Was throttled while checkpointing, will attempt again in %v seconds\n", k.config.CheckPointFreqSeconds)
-				} else {
-					k.config.ErrLogger.Printf("Failed to checkpoint after %v tries, giving up\n", i)
-					return err
-				}
-			case "InvalidStateException":
-				k.config.ErrLogger.Printf("Received Invalid State exception, client code should exit now\n")
-			default:
-				k.config.ErrLogger.Printf("Received error: (%s) when trying to checkpoint\n", err.Error())
+// Returns a copy of the input with any KPL aggregated records expanded into their user records
+func (k *DefaultRecordProcessor) deaggregate(input *ProcessRecordsInput) *ProcessRecordsInput {
+	expanded := *input
+	expanded.Records = make([]Record, 0, len(input.Records))
+	for _, r := range input.Records {
+		records, err := DeaggregateRecord(r)
+		if err != nil {
+			k.config.ErrLogger.Printf("%s, processing it as is\n", err.Error())
+			records = []Record{r}
+		}
+		expanded.Records = append(expanded.Records, records...)
+	}
+	return &expanded
+}
+
+// Leaves records that have been processed already out of the batch, and remembers the ones that get processed
+func (k *DefaultRecordProcessor) processBatchOnce(ctx context.Context, input *ProcessRecordsInput) ([]error, error) {
+	d := k.config.Deduplicator
+	if d == nil {
+		return k.processBatch(ctx, input)
+	}
+
+	errs := make([]error, len(input.Records))
+	fresh := *input
+	fresh.Records = nil
+	var index []int
+	for i, r := range input.Records {
+		seen, err := d.seen(ctx, r)
+		switch {
+		case err != nil:
+			errs[i] = k.handleFailure(ctx, r, err)
+		case !seen:
+			fresh.Records = append(fresh.Records, r)
+			index = append(index, i)
+		}
+	}
+	if len(fresh.Records) == 0 {
+		return errs, nil
+	}
+
+	freshErrs, err := k.processBatch(ctx, &fresh)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range index {
+		errs[i] = freshErrs[j]
+		if errs[i] == nil {
+			d.remember(ctx, fresh.Records[j], k.config.ErrLogger)
+		}
+	}
+	return errs, nil
+}
+
+// Records that fail are retried by handing just them to the batch func again, per the retry policy
+func (k *DefaultRecordProcessor) processBatch(ctx context.Context, input *ProcessRecordsInput) ([]error, error) {
+	policy := k.config.RecordRetry
+	errs, err := k.callBatchFunc(input)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make([]int, len(errs))
+	for i := range attempts {
+		attempts[i] = 1
+	}
+	for retry := 1; retry < policy.MaxAttempts; retry++ {
+		var failed []int
+		for i, err := range errs {
+			if err != nil && policy.retryable(err) {
+				failed = append(failed, i)
 			}
-			time.Sleep(time.Duration(int64(k.config.CheckPointFreqSeconds)) * time.Second)
-		} else {
-			return nil
 		}
+		if len(failed) == 0 {
+			break
+		}
+
+		if !sleepContext(ctx, policy.delay(retry)) {
+			break
+		}
+		again := *input
+		again.Records = make([]Record, len(failed))
+		for j, i := range failed {
+			again.Records[j] = input.Records[i]
+		}
+		againErrs, err := k.callBatchFunc(&again)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range failed {
+			errs[i] = againErrs[j]
+			attempts[i]++
+		}
+	}
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if attempts[i] > 1 {
+			err = &RetryError{Attempts: attempts[i], Err: err}
+		}
+		errs[i] = k.handleFailure(ctx, input.Records[i], err)
+	}
+	return errs, nil
+}
+
+func (k *DefaultRecordProcessor) callBatchFunc(input *ProcessRecordsInput) ([]error, error) {
+	shard, _ := ShardFromContext(input.Context())
+
+	// there's no telling which record a panic was down to, so every record in the call failed with it
+	var errs []error
+	if err := recoverPanic(k.config.ErrLogger, ExtendedSequenceNumber{}, func() error {
+		errs = k.batchFunc.ProcessBatch(shard, input)
+		return nil
+	}); err != nil {
+		errs = make([]error, len(input.Records))
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, nil
+	}
+	if errs == nil {
+		return make([]error, len(input.Records)), nil
+	}
+	if len(errs) != len(input.Records) {
+		return nil, fmt.Errorf("ProcessBatch returned (%d) outcomes for (%d) records", len(errs), len(input.Records))
+	}
+	return errs, nil
+}
+
+// Applies the failure policy to a record that failed for good. Returns nil if the record can be checkpointed past,
+// otherwise the error the record failed with.
+func (k *DefaultRecordProcessor) handleFailure(ctx context.Context, record Record, err error) error {
+	if ctx.Err() != nil {
+		// it may only have failed because it was cancelled, so it's not done with
+		return err
+	}
+	switch k.config.FailurePolicy {
+	case FailurePolicySkip:
+		k.config.ErrLogger.Printf("Skipping record (%s) after error: (%s)\n", record.SequenceNumber, err.Error())
+		return nil
+	case FailurePolicyDeadLetter:
+		return k.deadLetter(ctx, record, err)
+	default:
+		return err
+	}
+}
+
+// Sends a record that failed to the dead letter sink. Returns nil once the record is safely dead lettered, otherwise
+// the error the record failed with.
+func (k *DefaultRecordProcessor) deadLetter(ctx context.Context, record Record, err error) error {
+	if k.config.DeadLetterSink == nil {
+		k.config.ErrLogger.Printf("Could not dead letter record (%s): no dead letter sink configured\n", record.SequenceNumber)
+		return err
+	}
+	shard, _ := ShardFromContext(ctx)
+	if sinkErr := k.config.DeadLetterSink.WriteDeadLetter(newDeadLetter(shard.ShardID, record, err)); sinkErr != nil {
+		k.config.ErrLogger.Printf("Could not dead letter record (%s): (%s)\n", record.SequenceNumber, sinkErr.Error())
+		return err
+	}
+	k.config.ErrLogger.Printf("Dead lettered record (%s) after error: (%s)\n", record.SequenceNumber, err.Error())
+	return nil
+}
+
+// Processes a single record, retrying it per the retry policy. A panic counts as a failed attempt.
+func (k *DefaultRecordProcessor) processRecord(ctx context.Context, record Record) error {
+	ctx = contextWithRecord(ctx, newRecordMeta(record))
+	return k.config.RecordRetry.do(ctx, func() error {
+		return recoverPanic(k.config.ErrLogger, record.SequenceNumber, func() error {
+			return k.attempt(ctx, record)
+		})
+	})
+}
+
+func (k *DefaultRecordProcessor) attempt(ctx context.Context, record Record) error {
+	if k.config.RecordTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.config.RecordTimeout)
+		defer cancel()
+	}
+	return CallProcessingFunc(ctx, k.processingFunc, record)
+}
+
+// Returns the outcome of every record, the records after the first failure (or once ctx is cancelled) aren't
+// processed
+func (k *DefaultRecordProcessor) processSerially(ctx context.Context, records []Record) []error {
+	errs := make([]error, len(records))
+	for i, r := range records {
+		if ctx.Err() != nil {
+			for j := i; j < len(records); j++ {
+				errs[j] = errNotProcessed
+			}
+			break
+		}
+		if err := k.processRecord(ctx, r); err != nil {
+			if err = k.handleFailure(ctx, r, err); err == nil {
+				continue
+			}
+			errs[i] = err
+			for j := i + 1; j < len(records); j++ {
+				errs[j] = errNotProcessed
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// Checkpoints with retries, and checks the daemon recorded the sequence number that was asked for. A mismatch is
+// returned as a *CheckPointMismatchError along with the result. While the worker pool is processing a batch the
+// checkpoint is held back to the last record every worker is done with, and made once they all are.
+func (k *DefaultRecordProcessor) CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error) {
+	k.checkpointMux.Lock()
+	defer k.checkpointMux.Unlock()
+
+	if k.watermark != nil {
+		limit, held := k.watermark.limit(sequence)
+		if limit.IsZero() {
+			k.config.OutLogger.Println("Not checkpointing, no record is done with yet")
+			return CheckPointResult{}, nil
+		}
+		if held {
+			k.config.OutLogger.Printf("Holding checkpoint back to (%s), earlier records are still being processed\n", limit)
+		}
+		sequence = &limit
+	}
+
+	attempts := k.config.CheckPointRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var result CheckPointResult
+	var err error
+	for i := 0; i < attempts; i++ {
+		result, err = k.checkpointer.CheckPoint(sequence)
+		switch {
+		case err == nil:
+			return result, verifyCheckPoint(sequence, result)
+		case errors.Is(err, ErrShutdown):
+			k.config.OutLogger.Println("Encountered Shutdown Exception, skipping checkpoint")
+			return result, err
+		case errors.Is(err, ErrSentinelCheckPoint):
+			return result, err
+		case errors.Is(err, ErrInvalidState):
+			k.config.ErrLogger.Printf("Received Invalid State exception, client code should exit now\n")
+			return result, err
+		case !IsRetryable(err):
+			// e.g. the input has closed, trying again won't help
+			k.config.ErrLogger.Printf("Received error: (%s) when trying to checkpoint\n", err.Error())
+			return result, err
+		}
+		k.config.OutLogger.Printf("Received retryable error (%s) while checkpointing\n", err.Error())
+		if i == attempts-1 {
+			break
+		}
+		k.config.OutLogger.Printf("Will attempt checkpoint again in %v seconds\n", k.config.CheckPointFreqSeconds)
+		if !sleepContext(k.context(), time.Duration(int64(k.config.CheckPointFreqSeconds))*time.Second) {
+			k.config.ErrLogger.Println("Giving up on the checkpoint, the shard is done with")
+			return result, err
+		}
+	}
+	k.config.ErrLogger.Printf("Failed to checkpoint after %v tries, giving up\n", attempts)
+	return result, err
+}
+
+func (k *DefaultRecordProcessor) context() context.Context {
+	if k.ctx == nil {
+		return context.Background()
+	}
+	return k.ctx
+}
+
+func (k *DefaultRecordProcessor) setWatermark(w *watermark) {
+	k.checkpointMux.Lock()
+	defer k.checkpointMux.Unlock()
+	k.watermark = w
+}
+
+// Without a requested sequence number the daemon picks it, and it may not tell us what it recorded
+func verifyCheckPoint(requested *ExtendedSequenceNumber, result CheckPointResult) error {
+	if requested == nil || requested.IsZero() || result.SequenceNumber.IsZero() {
+		return nil
+	}
+	if !result.SequenceNumber.Equal(*requested) {
+		return &CheckPointMismatchError{Requested: *requested, Acknowledged: result.SequenceNumber}
 	}
 	return nil
 }
 
+func (k *DefaultRecordProcessor) CheckPointRecord(record Record) (CheckPointResult, error) {
+	seq := record.SequenceNumber
+	return k.CheckPoint(&seq)
+}
+
+// The handler is cleaned up by KCL.Run once the shutdown has been acked, so don't close it here
 func (k *DefaultRecordProcessor) Shutdown(input *ShutdownInput) error {
 	switch input.Reason {
 	case ZOMBIE:
-		// don't checkpoint, just cleanup and leave
+		// don't checkpoint, just leave
 		k.config.OutLogger.Println("Shutting down due to failover. Will not checkpoint.")
-		return k.handler.Cleanup()
+		return nil
 	case TERMINATE:
 		k.config.OutLogger.Println("Was told to terminate, will attempt to checkpoint.")
-		k.checkpointer.CheckPoint("", 0)
-		return k.handler.Cleanup()
+		return k.checkPointAll(true)
 	default:
 		k.config.ErrLogger.Println("Unknown shutdown reason, will terminate without checkpointing")
-		return k.handler.Cleanup()
+		return nil
 	}
 }
 func (k *DefaultRecordProcessor) ShutdownRequested(input *ShutdownRequestedInput) error {
+	if k.funcCheckPoints {
+		// checkpointing the whole batch could skip records the func hasn't made durable yet
+		k.config.OutLogger.Println("Was told to gracefully shutdown, leaving checkpointing to the processing func.")
+		return nil
+	}
 	k.config.OutLogger.Println("Was told to gracefully shutdown, will attempt to checkpoint.")
-	k.checkpointer.CheckPoint("", 0)
-	return k.handler.Cleanup()
+	return k.checkPointAll(false)
+}
+
+// Another worker has taken the lease, checkpointing now would fail (or worse, clobber the new owner's checkpoint)
+func (k *DefaultRecordProcessor) LeaseLost(input *LeaseLostInput) error {
+	k.config.OutLogger.Println("Lease was lost. Will not checkpoint.")
+	return nil
+}
+
+// The shard has been fully read, checkpointing with no sequence number records SHARD_END so the
+// child shards can be picked up.
+func (k *DefaultRecordProcessor) ShardEnded(input *ShardEndedInput) error {
+	k.config.OutLogger.Println("Reached the end of the shard, will checkpoint at SHARD_END.")
+	return k.checkPointAll(true)
+}
+
+// Checkpoints everything delivered so far, unless processing has stalled in which case the records acked without
+// being processed mustn't be checkpointed past. That's fine for a graceful shutdown, but the end of the shard can't be
+// acked without its checkpoint so it's an error there. A shutdown exception means the daemon has moved on and whoever
+// holds the lease now will checkpoint, so it isn't one.
+func (k *DefaultRecordProcessor) checkPointAll(shardEnd bool) error {
+	if k.stalled != nil {
+		if shardEnd {
+			return fmt.Errorf("stalled after error, can't checkpoint at the end of the shard: %w", k.stalled)
+		}
+		k.config.ErrLogger.Printf("Stalled after error: (%s), will not checkpoint past (%s)\n", k.stalled.Error(), k.largestSeq)
+		return nil
+	}
+	if _, err := k.CheckPoint(nil); err != nil && !errors.Is(err, ErrShutdown) {
+		return err
+	}
+	return nil
 }
 
 func NewDefaultRecordProcessor(config *KCLConfig, handler *IoHandler, checkpointer CheckPointer, processingFunc RecordProcessingFunc) *DefaultRecordProcessor {
+	processor := newDefaultRecordProcessor(config, handler, checkpointer)
+	processor.processingFunc = processingFunc
+	if config.Deduplicator != nil {
+		// outermost, so duplicates never reach the middleware (e.g. aren't counted by MetricsMiddleware)
+		processor.processingFunc = config.Deduplicator.middleware(config.ErrLogger)(processingFunc)
+	}
+	if f, ok := findCheckPointerAware(processingFunc); ok {
+		processor.checkPointFrom(f)
+	}
+	return processor
+}
+
+// Same as NewDefaultRecordProcessor but records are handed to batchFunc a whole processRecords message at a time
+func NewDefaultBatchRecordProcessor(config *KCLConfig, handler *IoHandler, checkpointer CheckPointer, batchFunc BatchProcessingFunc) *DefaultRecordProcessor {
+	processor := newDefaultRecordProcessor(config, handler, checkpointer)
+	processor.batchFunc = batchFunc
+	if f, ok := batchFunc.(CheckPointerAware); ok {
+		processor.checkPointFrom(f)
+	}
+	return processor
+}
+
+// What both constructors share
+func newDefaultRecordProcessor(config *KCLConfig, handler *IoHandler, checkpointer CheckPointer) *DefaultRecordProcessor {
 	processor := new(DefaultRecordProcessor)
 	processor.config = config
 	processor.handler = handler
 	processor.checkpointer = checkpointer
-	processor.processingFunc = processingFunc
 	return processor
 }
+
+// Leaves checkpointing to f, its checkpoints get the same retries as ours
+func (k *DefaultRecordProcessor) checkPointFrom(f CheckPointerAware) {
+	f.SetCheckPointer(k)
+	k.funcCheckPoints = true
+}
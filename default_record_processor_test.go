@@ -0,0 +1,160 @@
+package kclgo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedCheckPointer fails checkpoints with errs in turn, then succeeds at the sequence number asked for
+type scriptedCheckPointer struct {
+	mux   sync.Mutex
+	errs  []error
+	calls []*ExtendedSequenceNumber
+}
+
+func (c *scriptedCheckPointer) CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.calls = append(c.calls, sequence)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return CheckPointResult{}, err
+	}
+	if sequence == nil {
+		return CheckPointResult{}, nil
+	}
+	return CheckPointResult{SequenceNumber: *sequence}, nil
+}
+
+func (c *scriptedCheckPointer) CheckPointRecord(record Record) (CheckPointResult, error) {
+	return c.CheckPoint(&record.SequenceNumber)
+}
+
+func TestCheckPointRetries(t *testing.T) {
+	throttled := newCheckPointError(ErrThrottling.Error())
+	tests := []struct {
+		name      string
+		errs      []error
+		cancelled bool
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "succeeds", wantCalls: 1},
+		{name: "retried", errs: []error{throttled, throttled}, wantCalls: 3},
+		{name: "out of attempts", errs: []error{throttled, throttled, throttled}, wantErr: ErrThrottling, wantCalls: 3},
+		{name: "input closed", errs: []error{io.ErrUnexpectedEOF}, wantErr: io.ErrUnexpectedEOF, wantCalls: 1},
+		{name: "unknown exception", errs: []error{newCheckPointError("NopeException")}, wantErr: ErrUnknownCheckPoint, wantCalls: 1},
+		{name: "in flight", errs: []error{ErrCheckPointInFlight}, wantErr: ErrCheckPointInFlight, wantCalls: 1},
+		{name: "shard done with", errs: []error{throttled}, cancelled: true, wantErr: ErrThrottling, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.CheckPointRetries = 3
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				// a long wait between attempts that the cancelled context cuts short
+				config.CheckPointFreqSeconds = 60
+				cancel()
+			}
+			checkpointer := &scriptedCheckPointer{errs: tt.errs}
+			p := NewDefaultRecordProcessor(config, nil, checkpointer, RecordFunc(func(Record) error { return nil }))
+			p.Initialize(&InitializeInput{ShardID: "shardId-000000000001", ctx: ctx})
+
+			start := time.Now()
+			_, err := p.CheckPoint(&ExtendedSequenceNumber{SequenceNumber: "1"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckPoint() returned (%v), want (%v)", err, tt.wantErr)
+			}
+			if len(checkpointer.calls) != tt.wantCalls {
+				t.Errorf("checkpointed (%d) times, want (%d)", len(checkpointer.calls), tt.wantCalls)
+			}
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("CheckPoint() took (%v)", took)
+			}
+		})
+	}
+}
+
+// ackingCheckPointer acknowledges every checkpoint at ack, whatever was asked for
+type ackingCheckPointer struct {
+	ack ExtendedSequenceNumber
+}
+
+func (c *ackingCheckPointer) CheckPoint(*ExtendedSequenceNumber) (CheckPointResult, error) {
+	return CheckPointResult{SequenceNumber: c.ack}, nil
+}
+
+func (c *ackingCheckPointer) CheckPointRecord(Record) (CheckPointResult, error) {
+	return c.CheckPoint(nil)
+}
+
+func TestCheckPointMismatch(t *testing.T) {
+	seq := func(s string) *ExtendedSequenceNumber {
+		return &ExtendedSequenceNumber{SequenceNumber: s}
+	}
+	tests := []struct {
+		name      string
+		requested *ExtendedSequenceNumber
+		ack       ExtendedSequenceNumber
+		wantErr   bool
+	}{
+		{name: "same", requested: seq("5"), ack: *seq("5")},
+		{name: "leading zeros", requested: seq("05"), ack: *seq("5")},
+		{name: "different", requested: seq("5"), ack: *seq("4"), wantErr: true},
+		{name: "sub sequence", requested: &ExtendedSequenceNumber{SequenceNumber: "5", SubSequenceNumber: 1}, ack: *seq("5"), wantErr: true},
+		// the daemon doesn't always say what it recorded
+		{name: "not acknowledged", requested: seq("5")},
+		{name: "daemon picks", ack: *seq("4")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewDefaultRecordProcessor(testConfig(), nil, &ackingCheckPointer{ack: tt.ack}, RecordFunc(func(Record) error { return nil }))
+			result, err := p.CheckPoint(tt.requested)
+			if result.SequenceNumber != tt.ack {
+				t.Errorf("CheckPoint() result at (%s), want (%s)", result.SequenceNumber, tt.ack)
+			}
+			var mismatch *CheckPointMismatchError
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("CheckPoint() returned (%v)", err)
+				}
+				return
+			}
+			if !errors.As(err, &mismatch) || !errors.Is(err, ErrCheckPointMismatch) {
+				t.Fatalf("CheckPoint() returned (%v), want a *CheckPointMismatchError", err)
+			}
+			if mismatch.Requested != *tt.requested || mismatch.Acknowledged != tt.ack {
+				t.Errorf("mismatch between (%s) and (%s), want (%s) and (%s)", mismatch.Requested, mismatch.Acknowledged, *tt.requested, tt.ack)
+			}
+		})
+	}
+}
+
+func TestKCLRunHaltsOnCheckPointMismatch(t *testing.T) {
+	k, err := NewDefaultKCL(testConfig(), RecordFunc(func(Record) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDaemon{
+		messages: []string{initializeLine, processRecordsLine(testRecord("1", "a"), testRecord("2", "a")), shardEndedLine},
+		reply: func(CheckPointRequest) string {
+			acked := "1"
+			return mustMarshal(checkPointResponse{Action: "checkpoint", SequenceNumber: &acked})
+		},
+	}
+	if err := d.run(t, k); !errors.Is(err, ErrCheckPointMismatch) {
+		t.Fatalf("Run returned (%v), want ErrCheckPointMismatch", err)
+	}
+	if want := []string{"initialize"}; !equalStrings(d.acks, want) {
+		t.Errorf("acked (%v), want (%v)", d.acks, want)
+	}
+}
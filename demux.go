@@ -0,0 +1,222 @@
+package kclgo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	// A checkpoint response arrived when no checkpoint was waiting for one
+	ErrUnexpectedCheckPoint = errors.New("kclgo: unexpected checkpoint response")
+	// A checkpoint was requested while another one was still waiting on its response
+	ErrCheckPointInFlight = errors.New("kclgo: checkpoint already in flight")
+)
+
+type demuxMessage struct {
+	line   string
+	action ActionInterface
+	err    error
+}
+
+// messageDemux is the only reader of the input file once it's started. Checkpoint responses are handed to the
+// checkpoint waiting on them, every other message is queued up for KCL.Run in the order it arrived.
+type messageDemux struct {
+	handler *IoHandler
+	once    sync.Once
+
+	mux     sync.Mutex
+	queue   []demuxMessage
+	ready   chan struct{}
+	pending chan demuxMessage
+	readErr error
+
+	// hand records to the processor as they are decoded, only when KCLConfig.StreamingDecode is set
+	streamRecords bool
+	stream        *RecordStream
+
+	// closed once the input has ended, so processing that is still going can be cancelled
+	ending chan struct{}
+}
+
+func newMessageDemux(handler *IoHandler) *messageDemux {
+	d := new(messageDemux)
+	d.handler = handler
+	d.ready = make(chan struct{}, 1)
+	d.ending = make(chan struct{})
+	return d
+}
+
+func (d *messageDemux) start() {
+	d.once.Do(func() {
+		go d.read()
+	})
+}
+
+func (d *messageDemux) read() {
+	if d.handler.config.StreamingDecode {
+		d.readStream()
+		return
+	}
+
+	for {
+		line, err := d.handler.ReadLine()
+		if err != nil {
+			d.finish(err)
+			return
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		action, err := d.handler.LoadAction(&line)
+		if err != nil {
+			d.enqueue(demuxMessage{line: line, err: &ProtocolError{Line: line, Err: err}})
+			continue
+		}
+		d.dispatch(demuxMessage{line: line, action: action})
+	}
+}
+
+func (d *messageDemux) readStream() {
+	s := newMessageStream(d.handler.reader, d.handler.config.MaxMessageBytes)
+	for {
+		msg, err := s.next(d, d.streamRecords)
+		if err == io.EOF {
+			d.finish(err)
+			return
+		}
+		if err != nil {
+			// we can't find the start of the next message after a bad one
+			d.finish(&ProtocolError{Line: msg.line, Err: err})
+			return
+		}
+		switch {
+		case msg.err != nil:
+			d.enqueue(msg)
+		case msg.action != nil:
+			d.dispatch(msg)
+		}
+	}
+}
+
+func (d *messageDemux) dispatch(msg demuxMessage) {
+	d.mux.Lock()
+	pending := d.pending
+	d.pending = nil
+	d.mux.Unlock()
+
+	_, isResponse := msg.action.(*checkPointResponse)
+	switch {
+	case isResponse && pending != nil:
+		pending <- msg
+	case isResponse:
+		d.handler.config.ErrLogger.Println(&ProtocolError{Line: msg.line, Err: ErrUnexpectedCheckPoint})
+	default:
+		if pending != nil {
+			// The daemon won't send another action until we've acked the current one, so this can only mean
+			// the KCL has lost track of us. The documented guidance for an invalid state is to exit.
+			pending <- demuxMessage{line: msg.line, err: &ProtocolError{Line: msg.line, Err: newCheckPointError(ErrInvalidState.Error())}}
+		}
+		d.enqueue(msg)
+	}
+}
+
+func (d *messageDemux) enqueue(msg demuxMessage) {
+	d.mux.Lock()
+	d.queue = append(d.queue, msg)
+	d.mux.Unlock()
+
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (d *messageDemux) finish(err error) {
+	close(d.ending)
+	d.mux.Lock()
+	d.readErr = err
+	pending := d.pending
+	d.pending = nil
+	d.mux.Unlock()
+
+	if pending != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		pending <- demuxMessage{err: err}
+	}
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the next non checkpoint message from the daemon. Once the input has been read to the end the read
+// error (io.EOF for a closed input) is returned as the message error.
+func (d *messageDemux) next(ctx context.Context) (demuxMessage, error) {
+	d.start()
+	for {
+		d.mux.Lock()
+		if len(d.queue) > 0 {
+			msg := d.queue[0]
+			d.queue = d.queue[1:]
+			d.mux.Unlock()
+			return msg, nil
+		}
+		readErr := d.readErr
+		d.mux.Unlock()
+
+		if readErr != nil {
+			return demuxMessage{err: readErr}, nil
+		}
+
+		select {
+		case <-d.ready:
+		case <-ctx.Done():
+			return demuxMessage{}, ctx.Err()
+		}
+	}
+}
+
+// Must be called before the checkpoint request is written so the response can't race past us.
+// The returned channel receives exactly one message.
+func (d *messageDemux) expectCheckPoint() (<-chan demuxMessage, error) {
+	d.start()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.readErr == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if d.readErr != nil {
+		return nil, d.readErr
+	}
+	if d.pending != nil {
+		return nil, ErrCheckPointInFlight
+	}
+	if d.stream != nil {
+		// the response is behind whatever is left of the records being streamed
+		d.stream.spillover()
+	}
+	d.pending = make(chan demuxMessage, 1)
+	return d.pending, nil
+}
+
+func (d *messageDemux) setStream(stream *RecordStream) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.stream = stream
+}
+
+func (d *messageDemux) cancelCheckPoint(ch <-chan demuxMessage) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.pending != nil && (<-chan demuxMessage)(d.pending) == ch {
+		d.pending = nil
+	}
+}
@@ -0,0 +1,135 @@
+package kclgo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// A demux reading from a pipe, along with the end the test writes the daemon's messages to
+func testDemux(t *testing.T) (*messageDemux, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	handler := NewIOHandler(testConfig())
+	handler.inputFile = r
+	handler.reader = bufio.NewReader(r)
+	return handler.demux, w
+}
+
+func nextAction(t *testing.T, d *messageDemux) demuxMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := d.next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func checkPointReply(t *testing.T, ch <-chan demuxMessage) demuxMessage {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply to the checkpoint")
+		return demuxMessage{}
+	}
+}
+
+const checkPointLine = `{"action":"checkpoint","sequenceNumber":"1","subSequenceNumber":0}`
+
+func TestDemuxRoutesCheckPointResponses(t *testing.T) {
+	d, w := testDemux(t)
+	ch, err := d.expectCheckPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.expectCheckPoint(); !errors.Is(err, ErrCheckPointInFlight) {
+		t.Fatalf("second checkpoint got (%v), want ErrCheckPointInFlight", err)
+	}
+
+	w.WriteString(checkPointLine + "\n" + shardEndedLine + "\n")
+	if msg := checkPointReply(t, ch); msg.err != nil {
+		t.Fatalf("checkpoint got (%v)", msg.err)
+	} else if _, ok := msg.action.(*checkPointResponse); !ok {
+		t.Fatalf("checkpoint got a (%T)", msg.action)
+	}
+	if msg := nextAction(t, d); msg.err != nil {
+		t.Fatal(msg.err)
+	} else if _, ok := msg.action.(*ShardEndedInput); !ok {
+		t.Fatalf("next action is a (%T), want the shardEnded", msg.action)
+	}
+}
+
+func TestDemuxDropsUnexpectedCheckPointResponses(t *testing.T) {
+	d, w := testDemux(t)
+	w.WriteString(checkPointLine + "\n" + shardEndedLine + "\n")
+	if msg := nextAction(t, d); msg.err != nil {
+		t.Fatal(msg.err)
+	} else if _, ok := msg.action.(*ShardEndedInput); !ok {
+		t.Fatalf("next action is a (%T), want the shardEnded", msg.action)
+	}
+}
+
+func TestDemuxActionWhileCheckPointing(t *testing.T) {
+	d, w := testDemux(t)
+	ch, err := d.expectCheckPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the daemon lost track of us, the checkpoint fails and the action is still queued up
+	w.WriteString(shardEndedLine + "\n")
+	msg := checkPointReply(t, ch)
+	var checkPointErr *CheckPointError
+	if !errors.As(msg.err, &checkPointErr) || !errors.Is(msg.err, ErrInvalidState) {
+		t.Fatalf("checkpoint got (%v), want an invalid state", msg.err)
+	}
+	if msg := nextAction(t, d); msg.err != nil {
+		t.Fatal(msg.err)
+	} else if _, ok := msg.action.(*ShardEndedInput); !ok {
+		t.Fatalf("next action is a (%T), want the shardEnded", msg.action)
+	}
+}
+
+func TestDemuxInputEnds(t *testing.T) {
+	d, w := testDemux(t)
+	ch, err := d.expectCheckPoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(`{"action":"nope"}` + "\n")
+	w.Close()
+
+	if msg := checkPointReply(t, ch); !errors.Is(msg.err, io.ErrUnexpectedEOF) {
+		t.Fatalf("checkpoint got (%v), want io.ErrUnexpectedEOF", msg.err)
+	}
+	var protocolErr *ProtocolError
+	if msg := nextAction(t, d); !errors.As(msg.err, &protocolErr) {
+		t.Fatalf("next got (%v), want a *ProtocolError for the unknown action", msg.err)
+	}
+	if msg := nextAction(t, d); msg.err != io.EOF {
+		t.Fatalf("next got (%v), want io.EOF", msg.err)
+	}
+	select {
+	case <-d.ending:
+	default:
+		t.Fatal("ending isn't closed once the input has ended")
+	}
+	if _, err := d.expectCheckPoint(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("checkpoint after the input ended got (%v), want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,231 @@
+package kclgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The eventName of a DynamoDB stream record
+const (
+	DynamoDBInsert = "INSERT"
+	DynamoDBModify = "MODIFY"
+	DynamoDBRemove = "REMOVE"
+)
+
+// DynamoDBAttributeValue is a value in DynamoDB's attribute-value JSON, e.g. {"S":"foo"} or {"N":"42"}. Exactly one
+// of the fields is set.
+type DynamoDBAttributeValue struct {
+	S *string
+	// Numbers are kept as the decimal strings DynamoDB sends so none of their 38 digits of precision are lost
+	N    *string
+	B    []byte
+	SS   []string
+	NS   []string
+	BS   [][]byte
+	M    map[string]DynamoDBAttributeValue
+	L    []DynamoDBAttributeValue
+	NULL bool
+	BOOL *bool
+}
+
+func (v *DynamoDBAttributeValue) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 1 {
+		return fmt.Errorf("attribute value must have exactly one type, got (%d)", len(fields))
+	}
+
+	*v = DynamoDBAttributeValue{}
+	for t, raw := range fields {
+		var err error
+		switch t {
+		case "S":
+			err = json.Unmarshal(raw, &v.S)
+		case "N":
+			err = json.Unmarshal(raw, &v.N)
+		case "B":
+			// binary is base64 in the JSON, which is how encoding/json decodes a []byte anyway
+			err = json.Unmarshal(raw, &v.B)
+		case "SS":
+			err = json.Unmarshal(raw, &v.SS)
+		case "NS":
+			err = json.Unmarshal(raw, &v.NS)
+		case "BS":
+			err = json.Unmarshal(raw, &v.BS)
+		case "M":
+			err = json.Unmarshal(raw, &v.M)
+		case "L":
+			err = json.Unmarshal(raw, &v.L)
+		case "NULL":
+			err = json.Unmarshal(raw, &v.NULL)
+		case "BOOL":
+			err = json.Unmarshal(raw, &v.BOOL)
+		default:
+			return fmt.Errorf("unknown attribute value type (%s)", t)
+		}
+		if err != nil {
+			return fmt.Errorf("attribute value of type (%s): %v", t, err)
+		}
+	}
+	if v.S == nil && v.N == nil && v.B == nil && v.SS == nil && v.NS == nil && v.BS == nil && v.M == nil && v.L == nil && !v.NULL && v.BOOL == nil {
+		return errors.New("attribute value has no value")
+	}
+	return nil
+}
+
+// Value converts the attribute to plain Go: S is a string, N a json.Number, B a []byte, SS a []string, NS a
+// []json.Number, BS a [][]byte, M a map[string]interface{}, L a []interface{}, NULL nil and BOOL a bool
+func (v DynamoDBAttributeValue) Value() interface{} {
+	switch {
+	case v.S != nil:
+		return *v.S
+	case v.N != nil:
+		return json.Number(*v.N)
+	case v.B != nil:
+		return v.B
+	case v.SS != nil:
+		return v.SS
+	case v.NS != nil:
+		ns := make([]json.Number, len(v.NS))
+		for i, n := range v.NS {
+			ns[i] = json.Number(n)
+		}
+		return ns
+	case v.BS != nil:
+		return v.BS
+	case v.M != nil:
+		return DynamoDBItem(v.M).Map()
+	case v.L != nil:
+		l := make([]interface{}, len(v.L))
+		for i, e := range v.L {
+			l[i] = e.Value()
+		}
+		return l
+	case v.BOOL != nil:
+		return *v.BOOL
+	default:
+		return nil
+	}
+}
+
+// DynamoDBItem is an item (or its keys) in attribute-value JSON
+type DynamoDBItem map[string]DynamoDBAttributeValue
+
+// Map converts the item to plain Go values, see DynamoDBAttributeValue.Value. A nil item gives a nil map.
+func (i DynamoDBItem) Map() map[string]interface{} {
+	if i == nil {
+		return nil
+	}
+	m := make(map[string]interface{}, len(i))
+	for name, v := range i {
+		m[name] = v.Value()
+	}
+	return m
+}
+
+// Unmarshal fills the struct (or map) pointed to by dst from the item, using the same field names and `json` tags as
+// encoding/json. Numbers go into numeric (or json.Number) fields and binary into []byte fields.
+func (i DynamoDBItem) Unmarshal(dst interface{}) error {
+	b, err := json.Marshal(i.Map())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// DynamoDBStreamRecord is the change a DynamoDB stream record describes. Both the records the DynamoDB Streams Kinesis
+// adapter hands the daemon and the ones Kinesis Data Streams for DynamoDB puts on a stream have this shape.
+type DynamoDBStreamRecord struct {
+	EventID   string
+	EventName string
+	// Only set by the DynamoDB Streams adapter
+	EventVersion string
+	EventSource  string
+	AWSRegion    string
+	// Only set by Kinesis Data Streams for DynamoDB
+	TableName string
+
+	ApproximateCreationDateTime time.Time
+	Keys                        DynamoDBItem
+	// Which images are present depends on the StreamViewType and the event, e.g. an INSERT has no OldImage
+	NewImage       DynamoDBItem
+	OldImage       DynamoDBItem
+	SequenceNumber string
+	SizeBytes      int64
+	StreamViewType string
+}
+
+// The wire format, encoding/json matches keys case insensitively so this also covers the adapter's capitalisation
+type dynamoDBStreamRecord struct {
+	EventID      string `json:"eventID"`
+	EventName    string `json:"eventName"`
+	EventVersion string `json:"eventVersion"`
+	EventSource  string `json:"eventSource"`
+	AWSRegion    string `json:"awsRegion"`
+	TableName    string `json:"tableName"`
+	DynamoDB     struct {
+		ApproximateCreationDateTime json.RawMessage `json:"ApproximateCreationDateTime"`
+		Keys                        DynamoDBItem    `json:"Keys"`
+		NewImage                    DynamoDBItem    `json:"NewImage"`
+		OldImage                    DynamoDBItem    `json:"OldImage"`
+		SequenceNumber              string          `json:"SequenceNumber"`
+		SizeBytes                   int64           `json:"SizeBytes"`
+		StreamViewType              string          `json:"StreamViewType"`
+	} `json:"dynamodb"`
+}
+
+// Anything past this is too large to be a millisecond timestamp, so it must be in microseconds
+const maxMillisTimestamp = 1e14
+
+// Decodes the JSON of a DynamoDB stream record
+func DynamoDBStreamsDecoder() Decoder[DynamoDBStreamRecord] {
+	return DecoderFunc[DynamoDBStreamRecord](func(data []byte) (DynamoDBStreamRecord, error) {
+		var wire dynamoDBStreamRecord
+		if err := json.Unmarshal(data, &wire); err != nil {
+			return DynamoDBStreamRecord{}, err
+		}
+
+		// the streams API sends seconds, the adapter and Kinesis Data Streams milliseconds (or microseconds)
+		ts, err := decodeNumber(wire.DynamoDB.ApproximateCreationDateTime)
+		if err != nil {
+			return DynamoDBStreamRecord{}, fmt.Errorf("ApproximateCreationDateTime: %v", err)
+		}
+		var created time.Time
+		switch {
+		case ts == 0:
+		case math.Abs(ts) < minMillisTimestamp:
+			created = time.UnixMilli(int64(math.Round(ts * 1000)))
+		case math.Abs(ts) < maxMillisTimestamp:
+			created = time.UnixMilli(int64(math.Round(ts)))
+		default:
+			created = time.UnixMicro(int64(math.Round(ts)))
+		}
+
+		return DynamoDBStreamRecord{
+			EventID:                     wire.EventID,
+			EventName:                   wire.EventName,
+			EventVersion:                wire.EventVersion,
+			EventSource:                 wire.EventSource,
+			AWSRegion:                   wire.AWSRegion,
+			TableName:                   wire.TableName,
+			ApproximateCreationDateTime: created,
+			Keys:                        wire.DynamoDB.Keys,
+			NewImage:                    wire.DynamoDB.NewImage,
+			OldImage:                    wire.DynamoDB.OldImage,
+			SequenceNumber:              wire.DynamoDB.SequenceNumber,
+			SizeBytes:                   wire.DynamoDB.SizeBytes,
+			StreamViewType:              wire.DynamoDB.StreamViewType,
+		}, nil
+	})
+}
+
+// Builds a RecordProcessingFunc that hands each DynamoDB stream record to handle
+func NewDynamoDBStreamsProcessingFunc(handle func(context.Context, DynamoDBStreamRecord, RecordMeta) error) *TypedProcessingFunc[DynamoDBStreamRecord] {
+	return NewTypedProcessingFunc(DynamoDBStreamsDecoder(), handle)
+}
@@ -0,0 +1,194 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDynamoDBAttributeValue(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want interface{}
+	}{
+		{name: "S", json: `{"S":"foo"}`, want: "foo"},
+		{name: "empty S", json: `{"S":""}`, want: ""},
+		// more digits than a float64 holds
+		{name: "N", json: `{"N":"12345678901234567890123456789012345678"}`, want: json.Number("12345678901234567890123456789012345678")},
+		{name: "B", json: `{"B":"AAH/"}`, want: []byte{0x00, 0x01, 0xff}},
+		{name: "SS", json: `{"SS":["a","b"]}`, want: []string{"a", "b"}},
+		{name: "NS", json: `{"NS":["1","2.5"]}`, want: []json.Number{"1", "2.5"}},
+		{name: "BS", json: `{"BS":["AA==","AQ=="]}`, want: [][]byte{{0x00}, {0x01}}},
+		{name: "M", json: `{"M":{"a":{"S":"x"},"b":{"N":"1"}}}`, want: map[string]interface{}{"a": "x", "b": json.Number("1")}},
+		{name: "L", json: `{"L":[{"S":"x"},{"BOOL":false}]}`, want: []interface{}{"x", false}},
+		{name: "NULL", json: `{"NULL":true}`, want: nil},
+		{name: "BOOL", json: `{"BOOL":true}`, want: true},
+		{
+			name: "nested",
+			json: `{"M":{"list":{"L":[{"M":{"n":{"N":"7"},"tags":{"SS":["t"]}}},{"L":[{"NULL":true}]}]}}}`,
+			want: map[string]interface{}{
+				"list": []interface{}{
+					map[string]interface{}{"n": json.Number("7"), "tags": []string{"t"}},
+					[]interface{}{nil},
+				},
+			},
+		},
+		{name: "empty M", json: `{"M":{}}`, want: map[string]interface{}{}},
+		{name: "empty L", json: `{"L":[]}`, want: []interface{}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v DynamoDBAttributeValue
+			if err := json.Unmarshal([]byte(tt.json), &v); err != nil {
+				t.Fatal(err)
+			}
+			if got := v.Value(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Value() = (%#v), want (%#v)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDynamoDBAttributeValueErrors(t *testing.T) {
+	for _, line := range []string{
+		`{}`,
+		`{"S":"a","N":"1"}`,
+		`{"X":"a"}`,
+		`{"NULL":false}`,
+		`{"N":1}`,
+		`{"B":"not base64!"}`,
+		`{"M":{"a":{"S":"x","N":"1"}}}`,
+		`"foo"`,
+	} {
+		var v DynamoDBAttributeValue
+		if err := json.Unmarshal([]byte(line), &v); err == nil {
+			t.Errorf("%s unmarshalled without an error", line)
+		}
+	}
+}
+
+func TestDynamoDBItemUnmarshal(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type order struct {
+		ID        string            `json:"id"`
+		Total     float64           `json:"total"`
+		Count     int64             `json:"count"`
+		Exact     json.Number       `json:"exact"`
+		Paid      bool              `json:"paid"`
+		Note      *string           `json:"note"`
+		Blob      []byte            `json:"blob"`
+		Tags      []string          `json:"tags"`
+		Sizes     []int             `json:"sizes"`
+		Address   address           `json:"address"`
+		Lines     []address         `json:"lines"`
+		Extra     map[string]string `json:"extra"`
+		Untouched string            `json:"-"`
+	}
+	itemJSON := `{
+		"id":{"S":"o-1"},
+		"total":{"N":"12.5"},
+		"count":{"N":"3"},
+		"exact":{"N":"0.1000000000000000000001"},
+		"paid":{"BOOL":true},
+		"note":{"NULL":true},
+		"blob":{"B":"AAH/"},
+		"tags":{"SS":["a","b"]},
+		"sizes":{"NS":["1","2"]},
+		"address":{"M":{"city":{"S":"Paris"}}},
+		"lines":{"L":[{"M":{"city":{"S":"Oslo"}}},{"M":{"city":{"S":"Rome"}}}]},
+		"extra":{"M":{"k":{"S":"v"}}}
+	}`
+	var item DynamoDBItem
+	if err := json.Unmarshal([]byte(itemJSON), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	var got order
+	if err := item.Unmarshal(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := order{
+		ID:      "o-1",
+		Total:   12.5,
+		Count:   3,
+		Exact:   "0.1000000000000000000001",
+		Paid:    true,
+		Blob:    []byte{0x00, 0x01, 0xff},
+		Tags:    []string{"a", "b"},
+		Sizes:   []int{1, 2},
+		Address: address{City: "Paris"},
+		Lines:   []address{{City: "Oslo"}, {City: "Rome"}},
+		Extra:   map[string]string{"k": "v"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = (%+v), want (%+v)", got, want)
+	}
+
+	var wrongType struct {
+		ID int `json:"id"`
+	}
+	if err := item.Unmarshal(&wrongType); err == nil {
+		t.Error("a string unmarshalled into an int")
+	}
+	if DynamoDBItem(nil).Map() != nil {
+		t.Error("a nil item gave a map")
+	}
+}
+
+func TestDynamoDBStreamsDecoder(t *testing.T) {
+	created := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	tests := []struct {
+		name string
+		ts   string
+		want time.Time
+	}{
+		{name: "seconds", ts: `1600000000`, want: created},
+		{name: "fractional seconds", ts: `1600000000.123`, want: created.Add(123 * time.Millisecond)},
+		{name: "milliseconds", ts: `1600000000123`, want: created.Add(123 * time.Millisecond)},
+		{name: "microseconds", ts: `1600000000123456`, want: created.Add(123456 * time.Microsecond)},
+		{name: "as a string", ts: `"1600000000123"`, want: created.Add(123 * time.Millisecond)},
+		{name: "missing", ts: `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := `{"eventID":"e1","eventName":"MODIFY","eventVersion":"1.1","eventSource":"aws:dynamodb","awsRegion":"eu-west-1",` +
+				`"dynamodb":{"ApproximateCreationDateTime":` + tt.ts + `,"Keys":{"id":{"S":"o-1"}},"NewImage":{"id":{"S":"o-1"},"n":{"N":"2"}},` +
+				`"OldImage":{"id":{"S":"o-1"},"n":{"N":"1"}},"SequenceNumber":"111","SizeBytes":26,"StreamViewType":"NEW_AND_OLD_IMAGES"}}`
+			r, err := DynamoDBStreamsDecoder().Decode([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !r.ApproximateCreationDateTime.Equal(tt.want) {
+				t.Errorf("created at (%v), want (%v)", r.ApproximateCreationDateTime, tt.want)
+			}
+			if r.EventID != "e1" || r.EventName != DynamoDBModify || r.EventVersion != "1.1" || r.EventSource != "aws:dynamodb" ||
+				r.AWSRegion != "eu-west-1" || r.SequenceNumber != "111" || r.SizeBytes != 26 || r.StreamViewType != "NEW_AND_OLD_IMAGES" {
+				t.Errorf("decoded (%+v)", r)
+			}
+			if *r.Keys["id"].S != "o-1" || *r.NewImage["n"].N != "2" || *r.OldImage["n"].N != "1" {
+				t.Errorf("decoded the images as (%+v) and (%+v)", r.NewImage.Map(), r.OldImage.Map())
+			}
+		})
+	}
+
+	// Kinesis Data Streams for DynamoDB names the table and has no event version
+	line := `{"awsRegion":"eu-west-1","eventID":"e2","eventName":"REMOVE","tableName":"orders","eventSource":"aws:dynamodb",` +
+		`"dynamodb":{"ApproximateCreationDateTime":1600000000123,"Keys":{"id":{"S":"o-1"}},"OldImage":{"id":{"S":"o-1"}},"SizeBytes":10}}`
+	r, err := DynamoDBStreamsDecoder().Decode([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TableName != "orders" || r.EventName != DynamoDBRemove || r.NewImage != nil || r.OldImage == nil {
+		t.Errorf("decoded (%+v)", r)
+	}
+
+	if _, err := DynamoDBStreamsDecoder().Decode([]byte(`{"dynamodb":{"ApproximateCreationDateTime":true}}`)); err == nil {
+		t.Error("decoded a timestamp that isn't a number")
+	}
+}
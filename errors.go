@@ -1,5 +1,133 @@
 package kclgo
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type MalformedAction error
 
-type CheckPointError error
+// ProtocolError is returned from KCL.Run when a message from the MultiLangDaemon can't be understood.
+// There is no way to ack a message we can't decode so the daemon would wait on us forever.
+type ProtocolError struct {
+	Line string
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("kclgo: protocol error (%s) on line: (%s)", e.Err.Error(), strings.TrimSpace(e.Line))
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// A message from the daemon was larger than KCLConfig.MaxMessageBytes. The rest of the input can't be trusted
+// after this so it is fatal.
+var ErrMessageTooLarge = errors.New("kclgo: message exceeds the maximum message size")
+
+// ActionError is returned from KCL.Run when the processor fails to perform an action from the MultiLangDaemon. The
+// action isn't acked, so the process should exit with a non-zero status and let the daemon start a new one.
+type ActionError struct {
+	Action string
+	Err    error
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("kclgo: performing action (%s): %s", e.Action, e.Err.Error())
+}
+
+func (e *ActionError) Unwrap() error {
+	return e.Err
+}
+
+// HaltError is returned by KCL.Run when the failure policy stops processing after an action failed
+type HaltError struct {
+	Action string
+	Err    error
+}
+
+func (e *HaltError) Error() string {
+	return fmt.Sprintf("kclgo: halting after action (%s) failed: %s", e.Action, e.Err.Error())
+}
+
+func (e *HaltError) Unwrap() error {
+	return e.Err
+}
+
+// The exceptions the MultiLangDaemon can report back when asked to checkpoint. A CheckPointError unwraps to
+// one of these so callers can use errors.Is instead of matching on the exception name.
+var (
+	// The record processor has been shutdown (e.g. a failover), checkpointing is no longer possible
+	ErrShutdown = errors.New("ShutdownException")
+	// The checkpoint was throttled by DynamoDB, it can be retried after a backoff
+	ErrThrottling = errors.New("ThrottlingException")
+	// The KCL is in an invalid state, the documented guidance is that client code should exit
+	ErrInvalidState = errors.New("InvalidStateException")
+	// A dependency of the KCL (e.g. DynamoDB) failed, it can be retried
+	ErrKinesisClientLibDependency = errors.New("KinesisClientLibDependencyException")
+	// The daemon reported an exception kclgo doesn't know about
+	ErrUnknownCheckPoint = errors.New("unknown checkpoint exception")
+)
+
+var checkPointExceptions = map[string]error{
+	ErrShutdown.Error():                   ErrShutdown,
+	ErrThrottling.Error():                 ErrThrottling,
+	ErrInvalidState.Error():               ErrInvalidState,
+	ErrKinesisClientLibDependency.Error(): ErrKinesisClientLibDependency,
+}
+
+// CheckPointError is returned when a checkpoint fails. Exception is the name of the exception as reported
+// by the MultiLangDaemon and Err is the matching sentinel (ErrUnknownCheckPoint if it isn't recognised).
+type CheckPointError struct {
+	Exception string
+	Err       error
+}
+
+func (e *CheckPointError) Error() string {
+	return e.Exception
+}
+
+func (e *CheckPointError) Unwrap() error {
+	return e.Err
+}
+
+// Throttling and dependency failures are transient, everything else will fail again if retried
+func (e *CheckPointError) Retryable() bool {
+	return e.Err == ErrThrottling || e.Err == ErrKinesisClientLibDependency
+}
+
+func newCheckPointError(exception string) *CheckPointError {
+	err, there := checkPointExceptions[exception]
+	if !there {
+		err = ErrUnknownCheckPoint
+	}
+	return &CheckPointError{Exception: exception, Err: err}
+}
+
+var ErrCheckPointMismatch = errors.New("kclgo: checkpoint acknowledged at a different sequence number")
+
+// CheckPointMismatchError is returned by the DefaultRecordProcessor when the daemon acknowledges a checkpoint at a
+// different sequence number to the one that was asked for. It unwraps to ErrCheckPointMismatch.
+type CheckPointMismatchError struct {
+	Requested    ExtendedSequenceNumber
+	Acknowledged ExtendedSequenceNumber
+}
+
+func (e *CheckPointMismatchError) Error() string {
+	return fmt.Sprintf("kclgo: requested checkpoint at (%s) but the daemon acknowledged (%s)", e.Requested, e.Acknowledged)
+}
+
+func (e *CheckPointMismatchError) Unwrap() error {
+	return ErrCheckPointMismatch
+}
+
+// Reports whether err is (or wraps) a checkpoint failure that is worth retrying
+func IsRetryable(err error) bool {
+	var ce *CheckPointError
+	if errors.As(err, &ce) {
+		return ce.Retryable()
+	}
+	return false
+}
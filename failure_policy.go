@@ -0,0 +1,44 @@
+package kclgo
+
+import "fmt"
+
+// FailurePolicy is what happens to a batch when a record still fails after being retried
+type FailurePolicy int
+
+const (
+	// Stop the batch at the failed record without checkpointing past it, and have KCL.Run return the error so the
+	// process can exit with a non-zero status. The record is delivered again to whoever picks the shard up next.
+	FailurePolicyHalt FailurePolicy = iota
+	// Log the error and carry on as if the record succeeded, it is checkpointed past and lost
+	FailurePolicySkip
+	// Send the record to the KCLConfig.DeadLetterSink and carry on, halts if the record can't be dead lettered
+	FailurePolicyDeadLetter
+	// Stop the batch at the failed record and checkpoint up to it, then ack every message from the daemon without
+	// processing or checkpointing anything else until the process is restarted. The end of the shard can't be acked
+	// without checkpointing it, so KCL.Run returns an error there instead.
+	FailurePolicyStall
+)
+
+var failurePolicyNames = map[FailurePolicy]string{
+	FailurePolicyHalt:       "halt",
+	FailurePolicySkip:       "skip",
+	FailurePolicyDeadLetter: "deadLetter",
+	FailurePolicyStall:      "stall",
+}
+
+func (f FailurePolicy) String() string {
+	if name, there := failurePolicyNames[f]; there {
+		return name
+	}
+	return fmt.Sprintf("FailurePolicy(%d)", int(f))
+}
+
+// Parses the names used in the properties file: halt, skip, deadLetter or stall
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	for policy, policyName := range failurePolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return FailurePolicyHalt, fmt.Errorf("unknown failure policy (%s)", name)
+}
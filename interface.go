@@ -1,14 +1,41 @@
 package kclgo
 
+import "context"
+
 // This is the main interface to implement to process KCL records with your code
 type RecordProcessor interface {
 	Initialize(*InitializeInput) error
 	ProcessRecords(*ProcessRecordsInput) error
-	CheckPoint(sequenceNumber string, subSequenceNumber int) error
+	CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error)
 	Shutdown(*ShutdownInput) error
 	ShutdownRequested(*ShutdownRequestedInput) error
 }
 
+// Optional extension for the KCL 2.x "leaseLost" action. If your RecordProcessor doesn't implement it
+// a leaseLost message is delivered to Shutdown with a ZOMBIE reason.
+type LeaseLostProcessor interface {
+	LeaseLost(*LeaseLostInput) error
+}
+
+// Optional extension for the KCL 2.x "shardEnded" action. If your RecordProcessor doesn't implement it
+// a shardEnded message is delivered to Shutdown with a TERMINATE reason.
+type ShardEndedProcessor interface {
+	ShardEnded(*ShardEndedInput) error
+}
+
+// Optional extension for very large batches. When KCLConfig.StreamingDecode is set a processor implementing this is
+// handed the records of a processRecords message one at a time as they are decoded, instead of ProcessRecords being
+// called with all of them. input.Records is empty, read the records from the stream until Next returns false.
+type RecordStreamProcessor interface {
+	ProcessRecordStream(input *ProcessRecordsInput, records *RecordStream) error
+}
+
+// Optional extension, ProcessRecordsContext is called instead of ProcessRecords when a processor implements it.
+// ctx is the same as input.Context(), see there for when it is cancelled.
+type ContextRecordProcessor interface {
+	ProcessRecordsContext(ctx context.Context, input *ProcessRecordsInput) error
+}
+
 // If you need more complex record processing than this (Taking a single record, processing and returning an error)
 // Then create your own RecordProcessor interface and implement your own ProcessRecords and the rest of the interface
 // If your record processing is simple, just provide a function that implements this interface to the
@@ -17,10 +44,35 @@ type RecordProcessingFunc interface {
 	ProcessRecord(Record) error
 }
 
+// A RecordProcessingFunc the DefaultRecordProcessor calls ProcessRecordContext on instead. ctx says which shard and
+// record it is (see ShardFromContext and RecordFromContext), is cancelled along with the batch and has a deadline
+// when KCLConfig.RecordTimeout is set.
+type ContextRecordProcessingFunc interface {
+	RecordProcessingFunc
+	ProcessRecordContext(ctx context.Context, record Record) error
+}
+
 type CheckPointer interface {
-	//CheckPoints at a particular sequence number you provide or if no sequence number is given, the CheckPoint will be
-	// at the end of the most recently delivered list of records
-	CheckPoint(sequenceNumber string, subSequenceNumber int) error
+	//CheckPoints at a particular sequence number you provide or if no sequence number is given (nil), the CheckPoint
+	// will be at the end of the most recently delivered list of records
+	CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error)
+	// CheckPoints right after the given record, i.e. it won't be delivered again
+	CheckPointRecord(Record) (CheckPointResult, error)
+}
+
+// For sinks that work in bulk (database COPY, bulk HTTP APIs) give a BatchProcessingFunc to NewDefaultBatchKCL
+// instead of a RecordProcessingFunc. It gets every record of a processRecords message at once and returns one error
+// per record, nil where the record succeeded (a nil slice means they all did). The DefaultRecordProcessor only
+// checkpoints up to the first record that failed.
+type BatchProcessingFunc interface {
+	ProcessBatch(shard ShardContext, input *ProcessRecordsInput) []error
+}
+
+// Optional extension for a RecordProcessingFunc (or BatchProcessingFunc) that checkpoints itself, e.g. after records it has buffered are
+// durably written. The DefaultRecordProcessor hands it a CheckPointer when it is created and no longer checkpoints on
+// its own, except where the KCL requires it (at the end of a shard).
+type CheckPointerAware interface {
+	SetCheckPointer(CheckPointer)
 }
 
 type ActionInterface interface {
@@ -32,6 +84,13 @@ type ConfigInterface interface {
 	Parse(string) error
 }
 
+// Where the DefaultRecordProcessor sends records it has given up on, after which it checkpoints past them.
+// With the worker pool it is called from several goroutines at once. A sink that is an io.Closer is closed when
+// KCL.Run returns.
+type DeadLetterSink interface {
+	WriteDeadLetter(DeadLetter) error
+}
+
 // pass in whatever logger you want to use.
 type LoggerInterface interface {
 	Printf(format string, v ...interface{})
@@ -3,10 +3,12 @@ package kclgo
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"syscall"
 )
 
 type IoHandler struct {
@@ -16,6 +18,7 @@ type IoHandler struct {
 	errorFile  *os.File
 	reader     *bufio.Reader
 	mux        sync.Mutex
+	demux      *messageDemux
 }
 
 func (i *IoHandler) Init() (err error) {
@@ -45,17 +48,25 @@ func (i *IoHandler) Init() (err error) {
 	return
 }
 
+// Closes the files Init opened, stdin, stdout and stderr are left alone as the process may still want them (e.g. to
+// log why it is exiting)
 func (i *IoHandler) Cleanup() (err error) {
-	errors := make([]error, 3)
-	errors[0] = i.inputFile.Close()
-	errors[1] = i.outputFile.Close()
-	errors[2] = i.outputFile.Close()
+	var errs []error
+	if i.config.InputFileName != "" {
+		errs = append(errs, i.inputFile.Close())
+	}
+	if i.config.OutputFileName != "" {
+		errs = append(errs, i.outputFile.Close())
+	}
+	if i.config.ErrorFileName != "" {
+		errs = append(errs, i.errorFile.Close())
+	}
 
-	for _, e := range errors {
+	for _, e := range errs {
 		if e != nil {
 			err = e
+			break
 		}
-		break
 	}
 	return
 }
@@ -71,8 +82,7 @@ func (i *IoHandler) WriteLine(line string) (err error) {
 		return
 	}
 
-	err = i.outputFile.Sync()
-	return
+	return syncFile(i.outputFile)
 }
 
 // Write a line to the Error file.
@@ -84,20 +94,41 @@ func (i *IoHandler) WriteError(line string) (err error) {
 		return
 	}
 
-	err = i.errorFile.Sync()
-	return
+	return syncFile(i.errorFile)
+}
+
+// The MultiLangDaemon talks to us over pipes which can't be synced, writes to them aren't buffered anyway
+func syncFile(f *os.File) error {
+	err := f.Sync()
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+	return err
 }
 
 // Reads a line from the input file.
 // A single line read from the input_file (e.g. '{"Action" : "initialize", "shardId" : "shardId-000001"}')
 // KCL on the java side sends a single (could be huge) message and waits for a response
+// Once KCL.Run (or a checkpoint) has started reading messages this shouldn't be called directly, the reads would
+// race with the demultiplexer.
+// io.EOF is only returned once there is nothing left to read, a final line without a newline is returned as is.
+// A line longer than KCLConfig.MaxMessageBytes fails with ErrMessageTooLarge before it is all read into memory.
 func (i *IoHandler) ReadLine() (string, error) {
-	s, err := i.reader.ReadString('\n')
-	// soak up the EOF errors, those don't need to be returned
-	if err == io.EOF {
-		return s, nil
+	var line []byte
+	for {
+		frag, err := i.reader.ReadSlice('\n')
+		if max := i.config.MaxMessageBytes; max > 0 && len(line)+len(frag) > max {
+			return "", ErrMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		return string(line), err
 	}
-	return s, err
 }
 
 //Decodes a message from the MultiLangDaemon.
@@ -129,5 +160,6 @@ func (i *IoHandler) WriteCheckPointRequest(req CheckPointRequest) error {
 func NewIOHandler(config *KCLConfig) *IoHandler {
 	h := new(IoHandler)
 	h.config = config
+	h.demux = newMessageDemux(h)
 	return h
 }
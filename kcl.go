@@ -1,7 +1,10 @@
 package kclgo
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"strings"
 )
 
 type KCL struct {
@@ -9,22 +12,39 @@ type KCL struct {
 	checkpointer CheckPointer
 	processor    RecordProcessor
 	config       *KCLConfig
+	shard        ShardContext
 }
 
-func (k *KCL) performAction(action ActionInterface) (err error) {
+// A panic in the processor is returned as a *PanicError
+func (k *KCL) performAction(ctx context.Context, action ActionInterface) error {
+	return recoverPanic(k.config.ErrLogger, ExtendedSequenceNumber{}, func() error {
+		return k.dispatchAction(ctx, action)
+	})
+}
+
+func (k *KCL) dispatchAction(ctx context.Context, action ActionInterface) (err error) {
 	switch i := action.(type) {
 	case *InitializeInput:
+		k.shard = ShardContext{ShardID: i.ShardID, StartingSequenceNumber: i.SequenceNumber}
+		i.ctx = ctx
 		err = k.processor.Initialize(i)
 	case *ProcessRecordsInput:
-		err = k.processor.ProcessRecords(i)
+		shard := k.shard
+		shard.MillisBehindLatest = i.MillisBehindLatest
+		i.ctx = contextWithShard(ctx, shard)
+		i.setContentDecoder(newContentDecoder(k.config))
+		err = i.Perform(k.processor)
 	case *ShutdownInput:
 		err = k.processor.Shutdown(i)
 	case *ShutdownRequestedInput:
 		err = k.processor.ShutdownRequested(i)
-	case *checkPointResponse:
+	case *LeaseLostInput:
+		err = i.Perform(k.processor)
+	case *ShardEndedInput:
 		err = i.Perform(k.processor)
 	default:
-		return MalformedAction(fmt.Errorf("UnknownAction"))
+		// registered with RegisterAction
+		err = action.Perform(k.processor)
 	}
 
 	if err != nil {
@@ -33,55 +53,141 @@ func (k *KCL) performAction(action ActionInterface) (err error) {
 	return nil
 }
 
-func (k *KCL) reportDone(action ActionInterface) {
-	k.handler.WriteActionResponse(getActionResponse(action.GetAction()))
+func (k *KCL) reportDone(action ActionInterface) error {
+	return k.handler.WriteActionResponse(getActionResponse(action.GetAction()))
+}
 
+// After one of these has been acked the MultiLangDaemon has nothing more to send us for this shard
+func isFinalAction(action ActionInterface) bool {
+	switch action.(type) {
+	case *ShutdownInput, *ShutdownRequestedInput, *ShardEndedInput, *LeaseLostInput:
+		return true
+	default:
+		return false
+	}
 }
-func (k *KCL) handleLine(line *string) {
-	action, err := k.handler.LoadAction(line)
-	if err != nil {
-		k.config.ErrLogger.Printf("Error (%s) loading line: (%s) with action (%s)\n", *line, err.Error(), action.GetAction())
-		return
+
+// How much of a line goes in a log message, a processRecords line can be megabytes long
+const maxLoggedLine = 256
+
+func truncateLine(line string) string {
+	line = strings.TrimSpace(line)
+	if len(line) <= maxLoggedLine {
+		return line
 	}
-	err = k.performAction(action)
+	return fmt.Sprintf("%s... (%d bytes)", line[:maxLoggedLine], len(line))
+}
+
+// Performs and acks a single action from the daemon, returns true once the final action for the shard has been
+// acked. The failure policy only applies to errors processing records, they are returned as a *HaltError under
+// FailurePolicyHalt (and FailurePolicyDeadLetter, where it means a record couldn't be dead lettered) and logged with
+// the action acked anyway under the others. An error performing any other action is returned as an *ActionError.
+func (k *KCL) handleAction(ctx context.Context, line string, action ActionInterface) (bool, error) {
+	err := k.performAction(ctx, action)
 	if err != nil {
-		k.config.ErrLogger.Printf("Error (%s) loading line: (%s) with action (%s)\n", *line, err.Error(), action.GetAction())
-		return
+		k.config.ErrLogger.Printf("Error (%s) performing action (%s) on line: (%s)\n", err.Error(), action.GetAction(), truncateLine(line))
+		if _, records := action.(*ProcessRecordsInput); !records {
+			return false, &ActionError{Action: action.GetAction(), Err: err}
+		}
+		switch k.config.FailurePolicy {
+		case FailurePolicySkip, FailurePolicyStall:
+		default:
+			return false, &HaltError{Action: action.GetAction(), Err: err}
+		}
 	}
-	switch action.(type) {
-	case *checkPointResponse:
-		// don't respond to the response
-		return
-	default:
-		k.reportDone(action)
+	if err := k.reportDone(action); err != nil {
+		return false, err
 	}
-
+	return isFinalAction(action), nil
 }
-func (k *KCL) Run() {
+
+// Run reads and performs actions from the MultiLangDaemon until the input stream ends, the final action for the
+// shard (shutdown, shutdownRequested, shardEnded or leaseLost) has been acked, ctx is cancelled or the daemon
+// sends something we can't understand. A nil error means the shard was finished cleanly. A *HaltError means the
+// failure policy stopped processing and an *ActionError that some other action failed, either way the process should
+// exit with a non-zero status so the daemon can hand the shard to a new one.
+func (k *KCL) Run(ctx context.Context) error {
+	defer k.cleanup()
+
+	// what records are processed with, see ProcessRecordsInput.Context. Returning cancels it, which we only do
+	// after performing the final action.
+	processCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-k.handler.demux.ending:
+			cancel()
+		case <-processCtx.Done():
+		}
+	}()
+
 	for {
-		line, err := k.handler.ReadLine()
+		msg, err := k.handler.demux.next(ctx)
 		if err != nil {
-			k.config.ErrLogger.Println(err)
-		} else {
-			k.handleLine(&line)
+			return err
+		}
+
+		if msg.err == io.EOF {
+			k.config.OutLogger.Println("Input stream closed, exiting.")
+			return nil
+		}
+		if msg.err != nil {
+			return msg.err
+		}
+
+		done, err := k.handleAction(processCtx, msg.line, msg.action)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
 		}
 	}
 }
 
-func NewDefaultKCL(config *KCLConfig, processingFunc RecordProcessingFunc) (*KCL, error) {
-	k := new(KCL)
-	k.config = config
-	k.handler = NewIOHandler(config)
-	if err := k.handler.Init(); err != nil {
-		return nil, err
+// Closes anything in the config that can be closed and then the handler, the process is done with the shard. The
+// handler goes last so errors closing the rest can still be logged.
+func (k *KCL) cleanup() {
+	if c, ok := k.config.DeadLetterSink.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			k.config.ErrLogger.Printf("Error (%s) closing the dead letter sink\n", err.Error())
+		}
 	}
-	k.checkpointer = NewCheckPointer(k.handler)
-	k.processor = NewDefaultRecordProcessor(config, k.handler, k.checkpointer, processingFunc)
+	if k.config.Deduplicator != nil {
+		if err := k.config.Deduplicator.Close(); err != nil {
+			k.config.ErrLogger.Printf("Error (%s) closing the dedup store\n", err.Error())
+		}
+	}
+	k.handler.Cleanup()
+}
 
-	return k, nil
+// Any middleware is wrapped around processingFunc, the first being the outermost
+func NewDefaultKCL(config *KCLConfig, processingFunc RecordProcessingFunc, middleware ...Middleware) (*KCL, error) {
+	return newKCL(config, func(handler *IoHandler, checkpointer CheckPointer) RecordProcessor {
+		return NewDefaultRecordProcessor(config, handler, checkpointer, Chain(middleware...)(processingFunc))
+	})
+}
+
+// Same as NewDefaultKCL for a BatchProcessingFunc. There is no call per record for middleware to wrap, so there is
+// none.
+func NewDefaultBatchKCL(config *KCLConfig, batchFunc BatchProcessingFunc) (*KCL, error) {
+	return newKCL(config, func(handler *IoHandler, checkpointer CheckPointer) RecordProcessor {
+		return NewDefaultBatchRecordProcessor(config, handler, checkpointer, batchFunc)
+	})
 }
 
 func NewKCL(config *KCLConfig, processor RecordProcessor) (*KCL, error) {
+	return newKCL(config, func(*IoHandler, CheckPointer) RecordProcessor {
+		return processor
+	})
+}
+
+// What every constructor shares, newProcessor is handed the handler and checkpointer once they are set up
+func newKCL(config *KCLConfig, newProcessor func(*IoHandler, CheckPointer) RecordProcessor) (*KCL, error) {
+	if config.DeadLetterSink != nil && config.FailurePolicy != FailurePolicyDeadLetter {
+		// the zero value is FailurePolicyHalt, a sink set without changing it would never be used
+		return nil, fmt.Errorf("kclgo: a DeadLetterSink is only used with FailurePolicyDeadLetter, not (%s)", config.FailurePolicy)
+	}
 	k := new(KCL)
 	k.config = config
 	k.handler = NewIOHandler(config)
@@ -89,7 +195,8 @@ func NewKCL(config *KCLConfig, processor RecordProcessor) (*KCL, error) {
 		return nil, err
 	}
 	k.checkpointer = NewCheckPointer(k.handler)
-	k.processor = processor
+	k.processor = newProcessor(k.handler, k.checkpointer)
+	_, k.handler.demux.streamRecords = k.processor.(RecordStreamProcessor)
 
 	return k, nil
 }
@@ -0,0 +1,389 @@
+package kclgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeDaemon plays the MultiLangDaemon's side of a KCL's pipes. Each message is sent once the one before it has been
+// acked, the input is closed after the last one and checkpoints are answered with reply.
+type fakeDaemon struct {
+	messages []string
+	reply    func(CheckPointRequest) string
+
+	mux         sync.Mutex
+	acks        []string
+	checkpoints []CheckPointRequest
+}
+
+func (d *fakeDaemon) run(t *testing.T, k *KCL) error {
+	t.Helper()
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errFile, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.handler.inputFile = inR
+	k.handler.reader = bufio.NewReader(inR)
+	k.handler.outputFile = outW
+	k.handler.errorFile = errFile
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer inW.Close()
+		messages := d.messages
+		send := func() {
+			if len(messages) == 0 {
+				inW.Close()
+				return
+			}
+			inW.WriteString(messages[0] + "\n")
+			messages = messages[1:]
+		}
+		send()
+
+		scanner := bufio.NewScanner(outR)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var msg struct {
+				Action      string `json:"action"`
+				ResponseFor string `json:"responseFor"`
+			}
+			if len(scanner.Bytes()) == 0 || json.Unmarshal(scanner.Bytes(), &msg) != nil {
+				continue
+			}
+			switch msg.Action {
+			case "status":
+				d.mux.Lock()
+				d.acks = append(d.acks, msg.ResponseFor)
+				d.mux.Unlock()
+				send()
+			case "checkpoint":
+				var req CheckPointRequest
+				json.Unmarshal(scanner.Bytes(), &req)
+				d.mux.Lock()
+				d.checkpoints = append(d.checkpoints, req)
+				d.mux.Unlock()
+				inW.WriteString(d.replyTo(req) + "\n")
+			}
+		}
+	}()
+
+	err = k.Run(context.Background())
+	// the handler only closes files it opened itself
+	outW.Close()
+	<-done
+	inR.Close()
+	errFile.Close()
+	return err
+}
+
+func (d *fakeDaemon) replyTo(req CheckPointRequest) string {
+	if d.reply != nil {
+		return d.reply(req)
+	}
+	b, _ := json.Marshal(checkPointResponse{Action: "checkpoint", SequenceNumber: req.SequenceNumber})
+	return string(b)
+}
+
+// The sequence numbers checkpointed at, "" for a checkpoint without one
+func (d *fakeDaemon) checkpointed() []string {
+	seqs := make([]string, len(d.checkpoints))
+	for i, c := range d.checkpoints {
+		if c.SequenceNumber != nil {
+			seqs[i] = *c.SequenceNumber
+		}
+	}
+	return seqs
+}
+
+func testConfig() *KCLConfig {
+	return &KCLConfig{
+		OutLogger:         log.New(io.Discard, "", 0),
+		ErrLogger:         log.New(io.Discard, "", 0),
+		CheckPointRetries: 1,
+	}
+}
+
+func testRecord(seq string, partitionKey string) Record {
+	return Record{
+		Data:           base64.StdEncoding.EncodeToString([]byte("data " + seq)),
+		PartitionKey:   partitionKey,
+		SequenceNumber: ExtendedSequenceNumber{SequenceNumber: seq},
+		Action:         "record",
+	}
+}
+
+func processRecordsLine(records ...Record) string {
+	return mustMarshal(&ProcessRecordsInput{Action: "processRecords", Records: records})
+}
+
+func mustMarshal(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+const (
+	initializeLine = `{"action":"initialize","shardId":"shardId-000000000001","sequenceNumber":"TRIM_HORIZON","subSequenceNumber":0}`
+	shardEndedLine = `{"action":"shardEnded"}`
+)
+
+type deadLetters struct {
+	letters []DeadLetter
+}
+
+func (s *deadLetters) WriteDeadLetter(letter DeadLetter) error {
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestKCLRunFailurePolicies(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name   string
+		policy FailurePolicy
+		retry  RetryPolicy
+
+		wantErr         interface{}
+		wantAttempts    int
+		wantAcks        []string
+		wantCheckpoints []string
+		wantProcessed   []string
+		wantDeadLetters int
+	}{
+		{
+			name:          "halt",
+			policy:        FailurePolicyHalt,
+			wantErr:       new(*HaltError),
+			wantAcks:      []string{"initialize"},
+			wantProcessed: []string{"1"},
+		},
+		{
+			name:            "skip",
+			policy:          FailurePolicySkip,
+			wantAcks:        []string{"initialize", "processRecords", "shardEnded"},
+			wantCheckpoints: []string{"3", ""},
+			wantProcessed:   []string{"1", "3"},
+		},
+		{
+			name:            "deadLetter",
+			policy:          FailurePolicyDeadLetter,
+			wantAcks:        []string{"initialize", "processRecords", "shardEnded"},
+			wantCheckpoints: []string{"3", ""},
+			wantProcessed:   []string{"1", "3"},
+			wantDeadLetters: 1,
+		},
+		{
+			// the end of the shard isn't acked without checkpointing the records that stalled
+			name:            "stall",
+			policy:          FailurePolicyStall,
+			wantErr:         new(*ActionError),
+			wantAcks:        []string{"initialize", "processRecords"},
+			wantCheckpoints: []string{"1"},
+			wantProcessed:   []string{"1"},
+		},
+		{
+			name:          "retry exhaustion",
+			policy:        FailurePolicyHalt,
+			retry:         RetryPolicy{MaxAttempts: 3},
+			wantErr:       new(*RetryError),
+			wantAttempts:  3,
+			wantAcks:      []string{"initialize"},
+			wantProcessed: []string{"1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.FailurePolicy = tt.policy
+			config.RecordRetry = tt.retry
+			sink := new(deadLetters)
+			if tt.policy == FailurePolicyDeadLetter {
+				config.DeadLetterSink = sink
+			}
+
+			var processed []string
+			attempts := 0
+			k, err := NewDefaultKCL(config, RecordFunc(func(record Record) error {
+				if record.SequenceNumber.SequenceNumber == "2" {
+					attempts++
+					return boom
+				}
+				processed = append(processed, record.SequenceNumber.SequenceNumber)
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := &fakeDaemon{messages: []string{
+				initializeLine,
+				processRecordsLine(testRecord("1", "a"), testRecord("2", "a"), testRecord("3", "a")),
+				shardEndedLine,
+			}}
+			err = d.run(t, k)
+
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("Run returned (%v), want nil", err)
+				}
+			case **HaltError:
+				if !errors.As(err, want) || !errors.Is(err, boom) {
+					t.Fatalf("Run returned (%v), want a *HaltError for boom", err)
+				}
+			case **ActionError:
+				if !errors.As(err, want) || !errors.Is(err, boom) {
+					t.Fatalf("Run returned (%v), want an *ActionError for boom", err)
+				}
+			case **RetryError:
+				if !errors.As(err, want) || (*want).Attempts != tt.wantAttempts {
+					t.Fatalf("Run returned (%v), want a *RetryError after (%d) attempts", err, tt.wantAttempts)
+				}
+			}
+			if tt.wantAttempts > 0 && attempts != tt.wantAttempts {
+				t.Errorf("record attempted (%d) times, want (%d)", attempts, tt.wantAttempts)
+			}
+			if !equalStrings(d.acks, tt.wantAcks) {
+				t.Errorf("acked (%v), want (%v)", d.acks, tt.wantAcks)
+			}
+			if got := d.checkpointed(); !equalStrings(got, tt.wantCheckpoints) {
+				t.Errorf("checkpointed at (%v), want (%v)", got, tt.wantCheckpoints)
+			}
+			if !equalStrings(processed, tt.wantProcessed) {
+				t.Errorf("processed (%v), want (%v)", processed, tt.wantProcessed)
+			}
+			if len(sink.letters) != tt.wantDeadLetters {
+				t.Errorf("dead lettered (%d) records, want (%d)", len(sink.letters), tt.wantDeadLetters)
+			}
+			if tt.wantDeadLetters > 0 && sink.letters[0].ShardID != "shardId-000000000001" {
+				t.Errorf("dead letter has shard (%s)", sink.letters[0].ShardID)
+			}
+		})
+	}
+}
+
+func TestKCLRunShutdownCheckPoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr bool
+	}{
+		// whoever has the lease now checkpoints, so there's nothing to fail
+		{name: "shutdown exception", reply: `{"action":"checkpoint","error":"ShutdownException"}`},
+		{name: "invalid state", reply: `{"action":"checkpoint","error":"InvalidStateException"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewDefaultKCL(testConfig(), RecordFunc(func(Record) error { return nil }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &fakeDaemon{
+				messages: []string{initializeLine, `{"action":"shutdown","reason":"TERMINATE"}`},
+				reply:    func(CheckPointRequest) string { return tt.reply },
+			}
+			err = d.run(t, k)
+
+			var actionErr *ActionError
+			var haltErr *HaltError
+			switch {
+			case errors.As(err, &haltErr):
+				t.Fatalf("Run returned (%v), the failure policy is only for records", err)
+			case tt.wantErr && !errors.As(err, &actionErr):
+				t.Fatalf("Run returned (%v), want an *ActionError", err)
+			case !tt.wantErr && err != nil:
+				t.Fatalf("Run returned (%v), want nil", err)
+			}
+		})
+	}
+}
+
+func TestNewKCLRejectsUnusedDeadLetterSink(t *testing.T) {
+	for _, policy := range []FailurePolicy{FailurePolicyHalt, FailurePolicySkip, FailurePolicyStall} {
+		config := testConfig()
+		config.FailurePolicy = policy
+		config.DeadLetterSink = new(deadLetters)
+		if _, err := NewDefaultKCL(config, RecordFunc(func(Record) error { return nil })); err == nil {
+			t.Errorf("a DeadLetterSink was accepted with the (%s) failure policy", policy)
+		}
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	long := make([]byte, 3*maxLoggedLine)
+	for i := range long {
+		long[i] = 'x'
+	}
+	if got := truncateLine(" short\n"); got != "short" {
+		t.Errorf("truncateLine(short) = (%s)", got)
+	}
+	if got := truncateLine(string(long)); len(got) > maxLoggedLine+32 {
+		t.Errorf("truncateLine(long) kept (%d) bytes", len(got))
+	}
+}
+
+func TestKCLRunClosesOnlyFilesItOpened(t *testing.T) {
+	dir := t.TempDir()
+	config := testConfig()
+	config.InputFileName = filepath.Join(dir, "input")
+	if err := os.WriteFile(config.InputFileName, []byte(initializeLine+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewDefaultKCL(config, RecordFunc(func(Record) error { return nil }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stands in for stdout and stderr, which the process may still want once Run returns
+	out, err := os.Create(filepath.Join(dir, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	k.handler.outputFile = out
+	k.handler.errorFile = out
+
+	if err := k.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.WriteString("still open\n"); err != nil {
+		t.Errorf("output closed by Run: %v", err)
+	}
+	if _, err := k.handler.inputFile.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("input file Run opened got (%v) reading it afterwards, want os.ErrClosed", err)
+	}
+}
@@ -0,0 +1,252 @@
+package kclgo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Records put by the Kinesis Producer Library may be aggregated, several user records packed into one Kinesis record:
+//
+//	magic (4 bytes) | protobuf AggregatedRecord | md5 of the protobuf (16 bytes)
+//
+// with the protobuf being
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table     = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records                 = 3;
+//	}
+//	message Record {
+//	  required uint64 partition_key_index     = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes  data                    = 3;
+//	  repeated Tag    tags                    = 4;
+//	}
+var kplMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+const (
+	kplChecksumSize = md5.Size
+
+	aggPartitionKeyTable    = 1
+	aggExplicitHashKeyTable = 2
+	aggRecords              = 3
+
+	recPartitionKeyIndex    = 1
+	recExplicitHashKeyIndex = 2
+	recData                 = 3
+)
+
+var errProtobufTruncated = errors.New("kclgo: truncated protobuf")
+
+// Reports whether data starts with the KPL magic bytes and carries a valid checksum
+func isAggregated(data []byte) bool {
+	if len(data) < len(kplMagic)+kplChecksumSize || !bytes.HasPrefix(data, kplMagic) {
+		return false
+	}
+	body := data[len(kplMagic) : len(data)-kplChecksumSize]
+	sum := md5.Sum(body)
+	return bytes.Equal(sum[:], data[len(data)-kplChecksumSize:])
+}
+
+// DeaggregateRecord expands a KPL aggregated record into its user records. Each one keeps the Kinesis sequence number
+// of the aggregated record, gets its index as the SubSequenceNumber and the partition key (and explicit hash key) the
+// producer gave it. A record that isn't aggregated (no magic bytes or a bad checksum) is returned on its own, an error
+// is only returned for a blob that checks out but can't be decoded.
+func DeaggregateRecord(record Record) ([]Record, error) {
+	// user records are compressed on their own, not the aggregated record as a whole
+	data, err := record.RawData()
+	if err != nil || !isAggregated(data) {
+		return []Record{record}, nil
+	}
+
+	body := data[len(kplMagic) : len(data)-kplChecksumSize]
+	agg, err := decodeAggregatedRecord(body)
+	if err != nil {
+		return nil, fmt.Errorf("kclgo: could not deaggregate record (%s): %v", record.SequenceNumber, err)
+	}
+
+	records := make([]Record, 0, len(agg.records))
+	for i, sub := range agg.records {
+		if sub.partitionKeyIndex >= uint64(len(agg.partitionKeys)) {
+			return nil, fmt.Errorf("kclgo: could not deaggregate record (%s): partition key index (%d) out of range", record.SequenceNumber, sub.partitionKeyIndex)
+		}
+		r := record
+		r.Data = base64.StdEncoding.EncodeToString(sub.data)
+		r.PartitionKey = agg.partitionKeys[sub.partitionKeyIndex]
+		r.ExplicitHashKey = ""
+		if sub.hasExplicitHashKey {
+			if sub.explicitHashKeyIndex >= uint64(len(agg.explicitHashKeys)) {
+				return nil, fmt.Errorf("kclgo: could not deaggregate record (%s): explicit hash key index (%d) out of range", record.SequenceNumber, sub.explicitHashKeyIndex)
+			}
+			r.ExplicitHashKey = agg.explicitHashKeys[sub.explicitHashKeyIndex]
+		}
+		r.SequenceNumber.SubSequenceNumber = int64(i)
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+type aggregatedRecord struct {
+	partitionKeys    []string
+	explicitHashKeys []string
+	records          []aggregatedSubRecord
+}
+
+type aggregatedSubRecord struct {
+	partitionKeyIndex    uint64
+	explicitHashKeyIndex uint64
+	hasExplicitHashKey   bool
+	data                 []byte
+}
+
+func decodeAggregatedRecord(b []byte) (aggregatedRecord, error) {
+	var agg aggregatedRecord
+	p := protoReader{buf: b}
+	for !p.done() {
+		field, wireType, err := p.key()
+		if err != nil {
+			return agg, err
+		}
+		switch {
+		case field == aggPartitionKeyTable && wireType == wireBytes:
+			v, err := p.bytes()
+			if err != nil {
+				return agg, err
+			}
+			agg.partitionKeys = append(agg.partitionKeys, string(v))
+		case field == aggExplicitHashKeyTable && wireType == wireBytes:
+			v, err := p.bytes()
+			if err != nil {
+				return agg, err
+			}
+			agg.explicitHashKeys = append(agg.explicitHashKeys, string(v))
+		case field == aggRecords && wireType == wireBytes:
+			v, err := p.bytes()
+			if err != nil {
+				return agg, err
+			}
+			sub, err := decodeAggregatedSubRecord(v)
+			if err != nil {
+				return agg, err
+			}
+			agg.records = append(agg.records, sub)
+		default:
+			if err := p.skip(wireType); err != nil {
+				return agg, err
+			}
+		}
+	}
+	return agg, nil
+}
+
+func decodeAggregatedSubRecord(b []byte) (aggregatedSubRecord, error) {
+	var sub aggregatedSubRecord
+	p := protoReader{buf: b}
+	for !p.done() {
+		field, wireType, err := p.key()
+		if err != nil {
+			return sub, err
+		}
+		switch {
+		case field == recPartitionKeyIndex && wireType == wireVarint:
+			if sub.partitionKeyIndex, err = p.varint(); err != nil {
+				return sub, err
+			}
+		case field == recExplicitHashKeyIndex && wireType == wireVarint:
+			if sub.explicitHashKeyIndex, err = p.varint(); err != nil {
+				return sub, err
+			}
+			sub.hasExplicitHashKey = true
+		case field == recData && wireType == wireBytes:
+			if sub.data, err = p.bytes(); err != nil {
+				return sub, err
+			}
+		default:
+			// tags aren't used by anything downstream
+			if err := p.skip(wireType); err != nil {
+				return sub, err
+			}
+		}
+	}
+	return sub, nil
+}
+
+// Just enough of the protobuf wire format for the KPL messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func (p *protoReader) done() bool {
+	return p.pos >= len(p.buf)
+}
+
+func (p *protoReader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if p.pos >= len(p.buf) {
+			return 0, errProtobufTruncated
+		}
+		b := p.buf[p.pos]
+		p.pos++
+		v |= uint64(b&0x7F) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("kclgo: protobuf varint overflows 64 bits")
+}
+
+func (p *protoReader) key() (int, int, error) {
+	k, err := p.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(k >> 3), int(k & 7), nil
+}
+
+func (p *protoReader) bytes() ([]byte, error) {
+	n, err := p.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(p.buf)-p.pos) {
+		return nil, errProtobufTruncated
+	}
+	v := p.buf[p.pos : p.pos+int(n)]
+	p.pos += int(n)
+	return v, nil
+}
+
+func (p *protoReader) skip(wireType int) error {
+	var n int
+	switch wireType {
+	case wireVarint:
+		_, err := p.varint()
+		return err
+	case wireBytes:
+		_, err := p.bytes()
+		return err
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	default:
+		return fmt.Errorf("kclgo: unsupported protobuf wire type (%d)", wireType)
+	}
+	if n > len(p.buf)-p.pos {
+		return errProtobufTruncated
+	}
+	p.pos += n
+	return nil
+}
@@ -0,0 +1,227 @@
+package kclgo
+
+import (
+	"crypto/md5"
+	"errors"
+)
+
+// The most a Kinesis record can hold, counting its data and partition key
+const MaxKinesisRecordSize = 1024 * 1024
+
+// A user record too large to fit in an aggregated record on its own
+var ErrUserRecordTooLarge = errors.New("kclgo: user record is too large to aggregate")
+
+// UserRecord is a record to be packed into a KPL aggregated record
+type UserRecord struct {
+	PartitionKey string
+	// optional, overrides the hash of the partition key when the KPL decides which shard a record goes to
+	ExplicitHashKey string
+	Data            []byte
+}
+
+// AggregatedRecord is a packed KPL record ready to put on a stream. Like the KPL it is put with the partition key
+// (and explicit hash key) of the first user record in it.
+type AggregatedRecord struct {
+	PartitionKey    string
+	ExplicitHashKey string
+	Data            []byte
+}
+
+// Aggregator packs user records into KPL aggregated records that DeaggregateRecord (and the KCL) can expand again.
+// Records are added until the next one would take the aggregated record over the maximum size. The zero value is
+// ready to use with a maximum size of MaxKinesisRecordSize.
+type Aggregator struct {
+	maxSize int
+
+	records          []UserRecord
+	partitionKeys    map[string]uint64
+	partitionKeyList []string
+	hashKeys         map[string]uint64
+	hashKeyList      []string
+	protoSize        int
+}
+
+// Adds a record, returning the aggregated record that was full if adding it meant starting a new one
+func (a *Aggregator) Add(record UserRecord) (*AggregatedRecord, error) {
+	if a.partitionKeys == nil {
+		a.reset()
+	}
+	if a.sizeWith(record) <= a.limit() {
+		a.add(record)
+		return nil, nil
+	}
+	if len(a.records) == 0 {
+		return nil, ErrUserRecordTooLarge
+	}
+
+	full := a.Flush()
+	if a.sizeWith(record) > a.limit() {
+		return full, ErrUserRecordTooLarge
+	}
+	a.add(record)
+	return full, nil
+}
+
+// Returns the aggregated record for everything added since the last flush, nil if there is nothing to flush
+func (a *Aggregator) Flush() *AggregatedRecord {
+	if len(a.records) == 0 {
+		return nil
+	}
+
+	body := make([]byte, 0, a.protoSize)
+	for _, pk := range a.partitionKeyList {
+		body = appendProtoBytes(body, aggPartitionKeyTable, []byte(pk))
+	}
+	for _, ehk := range a.hashKeyList {
+		body = appendProtoBytes(body, aggExplicitHashKeyTable, []byte(ehk))
+	}
+	for _, r := range a.records {
+		var sub []byte
+		sub = appendProtoVarint(sub, recPartitionKeyIndex, a.partitionKeys[r.PartitionKey])
+		if r.ExplicitHashKey != "" {
+			sub = appendProtoVarint(sub, recExplicitHashKeyIndex, a.hashKeys[r.ExplicitHashKey])
+		}
+		sub = appendProtoBytes(sub, recData, r.Data)
+		body = appendProtoBytes(body, aggRecords, sub)
+	}
+
+	sum := md5.Sum(body)
+	data := make([]byte, 0, len(kplMagic)+len(body)+len(sum))
+	data = append(data, kplMagic...)
+	data = append(data, body...)
+	data = append(data, sum[:]...)
+
+	agg := &AggregatedRecord{
+		PartitionKey:    a.records[0].PartitionKey,
+		ExplicitHashKey: a.records[0].ExplicitHashKey,
+		Data:            data,
+	}
+	a.reset()
+	return agg
+}
+
+func (a *Aggregator) limit() int {
+	if a.maxSize <= 0 || a.maxSize > MaxKinesisRecordSize {
+		return MaxKinesisRecordSize
+	}
+	return a.maxSize
+}
+
+func (a *Aggregator) reset() {
+	a.records = nil
+	a.partitionKeys = make(map[string]uint64)
+	a.partitionKeyList = nil
+	a.hashKeys = make(map[string]uint64)
+	a.hashKeyList = nil
+	a.protoSize = 0
+}
+
+// The size the aggregated record would be with record added, including the partition key it is put with
+func (a *Aggregator) sizeWith(record UserRecord) int {
+	protoSize := a.protoSize + a.recordProtoSize(record)
+	putKey := record.PartitionKey
+	if len(a.records) > 0 {
+		putKey = a.records[0].PartitionKey
+	}
+	return len(kplMagic) + protoSize + md5.Size + len(putKey)
+}
+
+// What adding record adds to the protobuf, table entries for new keys included
+func (a *Aggregator) recordProtoSize(record UserRecord) int {
+	size := 0
+	pkIndex, there := a.partitionKeys[record.PartitionKey]
+	if !there {
+		pkIndex = uint64(len(a.partitionKeyList))
+		size += protoBytesSize(aggPartitionKeyTable, len(record.PartitionKey))
+	}
+
+	sub := protoVarintSize(recPartitionKeyIndex, pkIndex)
+	if record.ExplicitHashKey != "" {
+		ehkIndex, there := a.hashKeys[record.ExplicitHashKey]
+		if !there {
+			ehkIndex = uint64(len(a.hashKeyList))
+			size += protoBytesSize(aggExplicitHashKeyTable, len(record.ExplicitHashKey))
+		}
+		sub += protoVarintSize(recExplicitHashKeyIndex, ehkIndex)
+	}
+	sub += protoBytesSize(recData, len(record.Data))
+	return size + protoBytesSize(aggRecords, sub)
+}
+
+func (a *Aggregator) add(record UserRecord) {
+	a.protoSize += a.recordProtoSize(record)
+	if _, there := a.partitionKeys[record.PartitionKey]; !there {
+		a.partitionKeys[record.PartitionKey] = uint64(len(a.partitionKeyList))
+		a.partitionKeyList = append(a.partitionKeyList, record.PartitionKey)
+	}
+	if record.ExplicitHashKey != "" {
+		if _, there := a.hashKeys[record.ExplicitHashKey]; !there {
+			a.hashKeys[record.ExplicitHashKey] = uint64(len(a.hashKeyList))
+			a.hashKeyList = append(a.hashKeyList, record.ExplicitHashKey)
+		}
+	}
+	a.records = append(a.records, record)
+}
+
+// maxSize of 0 (or anything over it) means MaxKinesisRecordSize
+func NewAggregator(maxSize int) *Aggregator {
+	a := new(Aggregator)
+	a.maxSize = maxSize
+	a.reset()
+	return a
+}
+
+// Packs records into as few aggregated records as fit within the Kinesis record size limit, in order
+func AggregateRecords(records []UserRecord) ([]AggregatedRecord, error) {
+	a := NewAggregator(MaxKinesisRecordSize)
+	var out []AggregatedRecord
+	for _, r := range records {
+		full, err := a.Add(r)
+		if full != nil {
+			out = append(out, *full)
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+	if last := a.Flush(); last != nil {
+		out = append(out, *last)
+	}
+	return out, nil
+}
+
+func protoVarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func protoVarintSize(field int, v uint64) int {
+	return protoVarintLen(uint64(field<<3|wireVarint)) + protoVarintLen(v)
+}
+
+func protoBytesSize(field int, n int) int {
+	return protoVarintLen(uint64(field<<3|wireBytes)) + protoVarintLen(uint64(n)) + n
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field<<3|wireVarint))
+	return appendVarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|wireBytes))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,143 @@
+package kclgo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Deaggregates what the aggregator packed as if the KCL had delivered it, one sequence number per aggregated record
+func deaggregateAll(t *testing.T, aggs []AggregatedRecord) []Record {
+	t.Helper()
+	var records []Record
+	for i, agg := range aggs {
+		r := Record{
+			Data:           base64.StdEncoding.EncodeToString(agg.Data),
+			PartitionKey:   agg.PartitionKey,
+			SequenceNumber: ExtendedSequenceNumber{SequenceNumber: fmt.Sprint(i + 1)},
+		}
+		expanded, err := DeaggregateRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, expanded...)
+	}
+	return records
+}
+
+func TestAggregateRoundTrip(t *testing.T) {
+	users := []UserRecord{
+		{PartitionKey: "a", Data: []byte("one")},
+		{PartitionKey: "b", ExplicitHashKey: "340282366920938463463374607431768211455", Data: []byte("two")},
+		{PartitionKey: "a", Data: []byte{}},
+		{PartitionKey: "c", ExplicitHashKey: "340282366920938463463374607431768211455", Data: bytes.Repeat([]byte{0xff}, 300)},
+	}
+
+	tests := []struct {
+		name       string
+		aggregator *Aggregator
+		wantSplit  bool
+	}{
+		{name: "zero value", aggregator: new(Aggregator)},
+		{name: "default size", aggregator: NewAggregator(0)},
+		// too small for the last record to join the others
+		{name: "split", aggregator: NewAggregator(400), wantSplit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var aggs []AggregatedRecord
+			for _, u := range users {
+				full, err := tt.aggregator.Add(u)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if full != nil {
+					aggs = append(aggs, *full)
+				}
+			}
+			if last := tt.aggregator.Flush(); last != nil {
+				aggs = append(aggs, *last)
+			}
+			if split := len(aggs) > 1; split != tt.wantSplit {
+				t.Errorf("packed into (%d) records", len(aggs))
+			}
+			if tt.aggregator.Flush() != nil {
+				t.Error("flushed again with nothing added")
+			}
+			for _, agg := range aggs {
+				if size := len(agg.Data) + len(agg.PartitionKey); size > tt.aggregator.limit() {
+					t.Errorf("aggregated record is (%d) bytes, over (%d)", size, tt.aggregator.limit())
+				}
+			}
+
+			records := deaggregateAll(t, aggs)
+			if len(records) != len(users) {
+				t.Fatalf("got (%d) records back, want (%d)", len(records), len(users))
+			}
+			for i, r := range records {
+				data, err := r.RawData()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r.PartitionKey != users[i].PartitionKey || r.ExplicitHashKey != users[i].ExplicitHashKey || !bytes.Equal(data, users[i].Data) {
+					t.Errorf("record (%d) came back as (%s, %s, %q)", i, r.PartitionKey, r.ExplicitHashKey, data)
+				}
+			}
+			for i := 1; i < len(records); i++ {
+				if !records[i-1].SequenceNumber.Less(records[i].SequenceNumber) {
+					t.Errorf("record (%s) doesn't sort before (%s)", records[i-1].SequenceNumber, records[i].SequenceNumber)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregateRecordTooLarge(t *testing.T) {
+	a := NewAggregator(100)
+	if _, err := a.Add(UserRecord{PartitionKey: "a", Data: make([]byte, 100)}); !errors.Is(err, ErrUserRecordTooLarge) {
+		t.Fatalf("Add() got (%v), want ErrUserRecordTooLarge", err)
+	}
+
+	if _, err := a.Add(UserRecord{PartitionKey: "a", Data: []byte("small")}); err != nil {
+		t.Fatal(err)
+	}
+	full, err := a.Add(UserRecord{PartitionKey: "a", Data: make([]byte, 100)})
+	if !errors.Is(err, ErrUserRecordTooLarge) || full == nil {
+		t.Fatalf("Add() got (%v, %v), want the small record back and ErrUserRecordTooLarge", full, err)
+	}
+	if records := deaggregateAll(t, []AggregatedRecord{*full}); len(records) != 1 {
+		t.Errorf("flushed (%d) records, want the small one", len(records))
+	}
+}
+
+func TestDeaggregateRecordNotAggregated(t *testing.T) {
+	r := testRecord("1", "a")
+	records, err := DeaggregateRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Data != r.Data || records[0].SequenceNumber != r.SequenceNumber {
+		t.Errorf("got (%+v), want the record as is", records)
+	}
+}
+
+func TestAggregateRecords(t *testing.T) {
+	var users []UserRecord
+	for i := 0; i < 3; i++ {
+		// with the KPL framing no two of these fit in one record
+		users = append(users, UserRecord{PartitionKey: fmt.Sprint(i), Data: make([]byte, MaxKinesisRecordSize/2)})
+	}
+	aggs, err := AggregateRecords(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggs) != 3 {
+		t.Errorf("packed into (%d) records, want (3)", len(aggs))
+	}
+	if records := deaggregateAll(t, aggs); len(records) != len(users) {
+		t.Errorf("got (%d) records back, want (%d)", len(records), len(users))
+	}
+}
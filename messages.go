@@ -1,18 +1,58 @@
 package kclgo
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+)
 
 var _ ActionInterface = (*InitializeInput)(nil)
 var _ ActionInterface = (*ProcessRecordsInput)(nil)
 var _ ActionInterface = (*ShutdownInput)(nil)
 var _ ActionInterface = (*ShutdownRequestedInput)(nil)
+var _ ActionInterface = (*LeaseLostInput)(nil)
+var _ ActionInterface = (*ShardEndedInput)(nil)
 var _ ActionInterface = (*checkPointResponse)(nil)
 
 type InitializeInput struct {
+	Action  string
+	ShardID string
+	// The sequence number the shard is being resumed from, the zero value if the daemon didn't send one
+	SequenceNumber ExtendedSequenceNumber
+
+	ctx context.Context
+}
+
+// The context KCL.Run works on the shard with, cancelled the same way as ProcessRecordsInput.Context. The
+// DefaultRecordProcessor stops waiting to retry a checkpoint once it is.
+func (i *InitializeInput) Context() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+	return i.ctx
+}
+
+type initializeInputJSON struct {
 	Action            string  `json:"action"`
 	ShardID           string  `json:"shardId"`
 	SequenceNumber    *string `json:"sequenceNumber"`
-	SubSequenceNumber int     `json:"subSequenceNumber"`
+	SubSequenceNumber int64   `json:"subSequenceNumber"`
+}
+
+func (i *InitializeInput) UnmarshalJSON(b []byte) error {
+	var wire initializeInputJSON
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+	*i = InitializeInput{Action: wire.Action, ShardID: wire.ShardID}
+	if wire.SequenceNumber == nil {
+		return nil
+	}
+	seq, err := ParseExtendedSequenceNumber(*wire.SequenceNumber, wire.SubSequenceNumber)
+	if err != nil {
+		return err
+	}
+	i.SequenceNumber = seq
+	return nil
 }
 
 //{"action":"initialize","shardId":"shardId-000000000000","sequenceNumber":"TRIM_HORIZON","subSequenceNumber":0}
@@ -23,14 +63,67 @@ func (i *InitializeInput) GetAction() string {
 	return i.Action
 }
 
+// ShardContext describes the shard a batch of records came from
+type ShardContext struct {
+	ShardID string
+	// where the shard was resumed from when it was initialized
+	StartingSequenceNumber ExtendedSequenceNumber
+	MillisBehindLatest     int
+}
+
 // Process Records Input
 type ProcessRecordsInput struct {
 	Action             string   `json:"action"`
 	MillisBehindLatest int      `json:"millisBehindLatest"`
 	Records            []Record `json:"records"`
+
+	// set instead of Records when the records are being streamed to a RecordStreamProcessor
+	stream *RecordStream
+	ctx    context.Context
+}
+
+// The context the records should be processed with. It carries the shard (see ShardFromContext) and is cancelled
+// once the action that ends our hold on the shard (shutdown, shutdownRequested, leaseLost or shardEnded) has been
+// performed, the daemon closes the input or the context given to KCL.Run is done.
+func (p *ProcessRecordsInput) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// Has BinaryData decompress the payload of every record in the message with decoder
+func (p *ProcessRecordsInput) setContentDecoder(decoder *ContentDecoder) {
+	for i := range p.Records {
+		p.Records[i].decoder = decoder
+	}
+	if p.stream != nil {
+		p.stream.setContentDecoder(decoder)
+	}
 }
 
 func (p *ProcessRecordsInput) Perform(processor RecordProcessor) error {
+	if p.stream == nil {
+		return p.processRecords(processor)
+	}
+	defer p.stream.close()
+
+	if sp, ok := processor.(RecordStreamProcessor); ok {
+		return sp.ProcessRecordStream(p, p.stream)
+	}
+	for r, ok := p.stream.Next(); ok; r, ok = p.stream.Next() {
+		p.Records = append(p.Records, r)
+	}
+	if err := p.stream.Err(); err != nil {
+		return err
+	}
+	return p.processRecords(processor)
+}
+
+func (p *ProcessRecordsInput) processRecords(processor RecordProcessor) error {
+	if cp, ok := processor.(ContextRecordProcessor); ok {
+		return cp.ProcessRecordsContext(p.Context(), p)
+	}
 	return processor.ProcessRecords(p)
 }
 func (p *ProcessRecordsInput) GetAction() string {
@@ -68,11 +161,47 @@ func (s *ShutdownRequestedInput) GetAction() string {
 	return s.Action
 }
 
+// Lease Lost Input is sent by KCL 2.x when this worker no longer holds the lease for the shard.
+// Another worker may already be processing the shard, so it is not safe to checkpoint.
+type LeaseLostInput struct {
+	Action string `json:"action"`
+}
+
+// Processors that don't implement LeaseLostProcessor are sent a ZOMBIE shutdown instead, which is
+// what KCL 1.x would have sent for the same situation.
+func (l *LeaseLostInput) Perform(processor RecordProcessor) error {
+	if p, ok := processor.(LeaseLostProcessor); ok {
+		return p.LeaseLost(l)
+	}
+	return processor.Shutdown(&ShutdownInput{Action: "shutdown", Reason: ZOMBIE})
+}
+func (l *LeaseLostInput) GetAction() string {
+	return l.Action
+}
+
+// Shard Ended Input is sent by KCL 2.x when the end of the shard has been reached (e.g. after a split or merge).
+// The processor must checkpoint (with no sequence number, i.e. at SHARD_END) before the child shards are processed.
+type ShardEndedInput struct {
+	Action string `json:"action"`
+}
+
+// Processors that don't implement ShardEndedProcessor are sent a TERMINATE shutdown instead, which is
+// what KCL 1.x would have sent for the same situation.
+func (s *ShardEndedInput) Perform(processor RecordProcessor) error {
+	if p, ok := processor.(ShardEndedProcessor); ok {
+		return p.ShardEnded(s)
+	}
+	return processor.Shutdown(&ShutdownInput{Action: "shutdown", Reason: TERMINATE})
+}
+func (s *ShardEndedInput) GetAction() string {
+	return s.Action
+}
+
 // CheckPoint messages are different, they get sent upon call to checkpoint()
 type CheckPointRequest struct {
 	Action            string  `json:"action"`            // checkpoint
 	SequenceNumber    *string `json:"sequenceNumber"`    // can be none
-	SubSequenceNumber int     `json:"subSequenceNumber"` // always a number, default to 0
+	SubSequenceNumber int64   `json:"subSequenceNumber"` // always a number, default to 0
 }
 
 // CheckPoint response from the server upon being instructed to checkpoint
@@ -83,9 +212,26 @@ type checkPointResponse struct {
 	SubSequenceNumber *int    `json:"subSequenceNumber"`
 }
 
+// CheckPointResult is what the MultiLangDaemon reported back for a successful checkpoint
+type CheckPointResult struct {
+	// The sequence number the daemon says it recorded, the zero value if it didn't say
+	SequenceNumber ExtendedSequenceNumber
+}
+
+func (c *checkPointResponse) result() CheckPointResult {
+	if c.SequenceNumber == nil {
+		return CheckPointResult{}
+	}
+	seq := ExtendedSequenceNumber{SequenceNumber: *c.SequenceNumber}
+	if c.SubSequenceNumber != nil {
+		seq.SubSequenceNumber = int64(*c.SubSequenceNumber)
+	}
+	return CheckPointResult{SequenceNumber: seq}
+}
+
 func (c *checkPointResponse) Perform(processor RecordProcessor) error {
 	if c.Error != nil {
-		return CheckPointError(errors.New(*c.Error))
+		return newCheckPointError(*c.Error)
 	}
 	return nil
 }
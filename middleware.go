@@ -0,0 +1,166 @@
+package kclgo
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a RecordProcessingFunc with something that should happen around every record, e.g. logging
+type Middleware func(RecordProcessingFunc) RecordProcessingFunc
+
+// RecordFunc adapts a plain function to a RecordProcessingFunc
+type RecordFunc func(Record) error
+
+func (f RecordFunc) ProcessRecord(record Record) error {
+	return f(record)
+}
+
+// Chain combines middleware into one, the first being the outermost. Chain(a, b)(f) is a(b(f)).
+func Chain(middleware ...Middleware) Middleware {
+	return func(next RecordProcessingFunc) RecordProcessingFunc {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			next = middleware[i](next)
+		}
+		return next
+	}
+}
+
+// What the built in middleware wrap a func in, it keeps hold of the func so the DefaultRecordProcessor can still find
+// out if it is CheckPointerAware
+type wrappedFunc struct {
+	next    RecordProcessingFunc
+	process func(context.Context, Record) error
+}
+
+func (w *wrappedFunc) ProcessRecord(record Record) error {
+	return w.process(context.Background(), record)
+}
+
+func (w *wrappedFunc) ProcessRecordContext(ctx context.Context, record Record) error {
+	return w.process(ctx, record)
+}
+
+// Unwrap returns the func that was wrapped. Middleware of your own can implement it too.
+func (w *wrappedFunc) Unwrap() RecordProcessingFunc {
+	return w.next
+}
+
+// Wraps next so that process is called for every record instead, for writing middleware. Pass ctx on with
+// CallProcessingFunc so a ContextRecordProcessingFunc still gets it.
+func WrapProcessingFunc(next RecordProcessingFunc, process func(ctx context.Context, record Record) error) RecordProcessingFunc {
+	return &wrappedFunc{next: next, process: process}
+}
+
+// Calls f with ctx if it is a ContextRecordProcessingFunc, without it otherwise
+func CallProcessingFunc(ctx context.Context, f RecordProcessingFunc, record Record) error {
+	if cf, ok := f.(ContextRecordProcessingFunc); ok {
+		return cf.ProcessRecordContext(ctx, record)
+	}
+	return f.ProcessRecord(record)
+}
+
+// Looks through any middleware for a func that wants to checkpoint itself
+func findCheckPointerAware(f RecordProcessingFunc) (CheckPointerAware, bool) {
+	for f != nil {
+		if aware, ok := f.(CheckPointerAware); ok {
+			return aware, true
+		}
+		u, ok := f.(interface{ Unwrap() RecordProcessingFunc })
+		if !ok {
+			return nil, false
+		}
+		f = u.Unwrap()
+	}
+	return nil, false
+}
+
+// Logs every record that fails, and every record processed when verbose is set
+func LoggingMiddleware(logger LoggerInterface, verbose bool) Middleware {
+	return func(next RecordProcessingFunc) RecordProcessingFunc {
+		return WrapProcessingFunc(next, func(ctx context.Context, record Record) error {
+			err := CallProcessingFunc(ctx, next, record)
+			switch {
+			case err != nil:
+				logger.Printf("Record (%s) with partition key (%s) failed: (%s)\n", record.SequenceNumber, record.PartitionKey, err.Error())
+			case verbose:
+				logger.Printf("Processed record (%s) with partition key (%s)\n", record.SequenceNumber, record.PartitionKey)
+			}
+			return err
+		})
+	}
+}
+
+// Calls observe with how long each record took to process and how it went
+func TimingMiddleware(observe func(record Record, took time.Duration, err error)) Middleware {
+	return func(next RecordProcessingFunc) RecordProcessingFunc {
+		return WrapProcessingFunc(next, func(ctx context.Context, record Record) error {
+			start := time.Now()
+			err := CallProcessingFunc(ctx, next, record)
+			observe(record, time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// ProcessingMetrics counts the records that went through MetricsMiddleware, it is safe to read while records are
+// being processed
+type ProcessingMetrics struct {
+	processed int64
+	failed    int64
+	// nanoseconds
+	totalTime int64
+}
+
+// Records processed, failures included
+func (m *ProcessingMetrics) Processed() int64 {
+	return atomic.LoadInt64(&m.processed)
+}
+
+func (m *ProcessingMetrics) Failed() int64 {
+	return atomic.LoadInt64(&m.failed)
+}
+
+// Time spent processing records, across every worker
+func (m *ProcessingMetrics) TotalTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.totalTime))
+}
+
+// Counts records, failures and the time spent on them in m
+func MetricsMiddleware(m *ProcessingMetrics) Middleware {
+	return TimingMiddleware(func(record Record, took time.Duration, err error) {
+		atomic.AddInt64(&m.processed, 1)
+		atomic.AddInt64(&m.totalTime, int64(took))
+		if err != nil {
+			atomic.AddInt64(&m.failed, 1)
+		}
+	})
+}
+
+// RecordError is how ErrorWrappingMiddleware returns an error, with the record it came from
+type RecordError struct {
+	SequenceNumber ExtendedSequenceNumber
+	PartitionKey   string
+	Err            error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("kclgo: record (%s) with partition key (%s): %s", e.SequenceNumber, e.PartitionKey, e.Err.Error())
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps every error in a *RecordError so it says which record it came from
+func ErrorWrappingMiddleware() Middleware {
+	return func(next RecordProcessingFunc) RecordProcessingFunc {
+		return WrapProcessingFunc(next, func(ctx context.Context, record Record) error {
+			if err := CallProcessingFunc(ctx, next, record); err != nil {
+				return &RecordError{SequenceNumber: record.SequenceNumber, PartitionKey: record.PartitionKey, Err: err}
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package kclgo
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is what a panic in user code is turned into, so it can go through the failure policy like any other
+// error instead of killing the process mid-batch
+type PanicError struct {
+	// The record being processed, zero when the panic wasn't in the processing of a single record (e.g. in a
+	// BatchProcessingFunc or a RecordProcessor method)
+	SequenceNumber ExtendedSequenceNumber
+	// What was passed to panic
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.SequenceNumber.IsZero() {
+		return fmt.Sprintf("kclgo: panic: %v", e.Value)
+	}
+	return fmt.Sprintf("kclgo: panic processing record (%s): %v", e.SequenceNumber, e.Value)
+}
+
+// Lets errors.Is and errors.As see through to an error that was passed to panic
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Calls fn, turning a panic into a *PanicError. The stack is logged here as the error will usually only be logged by
+// its message.
+func recoverPanic(logger LoggerInterface, seq ExtendedSequenceNumber, fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p := &PanicError{SequenceNumber: seq, Value: v, Stack: debug.Stack()}
+			logger.Printf("Recovered from %s\n%s", p.Error(), p.Stack)
+			err = p
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,160 @@
+package kclgo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type batchFunc func(ShardContext, *ProcessRecordsInput) []error
+
+func (f batchFunc) ProcessBatch(shard ShardContext, input *ProcessRecordsInput) []error {
+	return f(shard, input)
+}
+
+// panickyProcessor panics in Initialize, the rest it leaves to the streamProcessor
+type panickyProcessor struct {
+	streamProcessor
+}
+
+func (p *panickyProcessor) Initialize(*InitializeInput) error {
+	panic("can't initialize")
+}
+
+func TestRecoverPanic(t *testing.T) {
+	boom := errors.New("boom")
+	seq := ExtendedSequenceNumber{SequenceNumber: "7"}
+	err := recoverPanic(testConfig().ErrLogger, seq, func() error { panic(boom) })
+
+	var p *PanicError
+	if !errors.As(err, &p) {
+		t.Fatalf("recoverPanic() returned (%v), want a *PanicError", err)
+	}
+	if p.SequenceNumber != seq || p.Value != boom || len(p.Stack) == 0 {
+		t.Errorf("got (%+v)", p)
+	}
+	if !errors.Is(err, boom) {
+		t.Error("doesn't unwrap to the error passed to panic")
+	}
+	if !strings.Contains(err.Error(), "(7)") {
+		t.Errorf("(%s) doesn't name the record", err.Error())
+	}
+
+	err = recoverPanic(testConfig().ErrLogger, ExtendedSequenceNumber{}, func() error { panic("not an error") })
+	if !errors.As(err, &p) || errors.Unwrap(err) != nil || err.Error() != "kclgo: panic: not an error" {
+		t.Errorf("recoverPanic() returned (%v)", err)
+	}
+	if err := recoverPanic(testConfig().ErrLogger, seq, func() error { return boom }); err != boom {
+		t.Errorf("recoverPanic() returned (%v) without a panic", err)
+	}
+}
+
+func TestKCLRunPanicIsAFailedAttempt(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		panics  int
+
+		wantErr         bool
+		wantAttempts    int
+		wantCheckpoints []string
+	}{
+		{name: "retried", panics: 2, wantAttempts: 3, wantCheckpoints: []string{"2", ""}},
+		{name: "out of attempts", panics: 3, wantErr: true, wantAttempts: 3},
+		{name: "retried in a worker", workers: 2, panics: 2, wantAttempts: 3, wantCheckpoints: []string{"2", ""}},
+		{name: "out of attempts in a worker", workers: 2, panics: 3, wantErr: true, wantAttempts: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.RecordRetry = RetryPolicy{MaxAttempts: 3}
+			config.ProcessingWorkers = tt.workers
+
+			var mux sync.Mutex
+			attempts := 0
+			k, err := NewDefaultKCL(config, RecordFunc(func(record Record) error {
+				if record.SequenceNumber.SequenceNumber != "1" {
+					return nil
+				}
+				mux.Lock()
+				attempts++
+				panicking := attempts <= tt.panics
+				mux.Unlock()
+				if panicking {
+					panic("boom")
+				}
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(testRecord("1", "a"), testRecord("2", "b")), shardEndedLine}}
+			err = d.run(t, k)
+
+			var halt *HaltError
+			var p *PanicError
+			var retried *RetryError
+			switch {
+			case !tt.wantErr && err != nil:
+				t.Fatalf("Run returned (%v), want nil", err)
+			case tt.wantErr && !(errors.As(err, &halt) && errors.As(err, &p) && errors.As(err, &retried)):
+				t.Fatalf("Run returned (%v), want a *HaltError for a *PanicError after retrying", err)
+			case tt.wantErr && (p.SequenceNumber.SequenceNumber != "1" || retried.Attempts != tt.wantAttempts):
+				t.Errorf("panicked at (%s) after (%d) attempts", p.SequenceNumber, retried.Attempts)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("record attempted (%d) times, want (%d)", attempts, tt.wantAttempts)
+			}
+			if got := d.checkpointed(); !equalStrings(got, tt.wantCheckpoints) {
+				t.Errorf("checkpointed at (%v), want (%v)", got, tt.wantCheckpoints)
+			}
+		})
+	}
+}
+
+func TestKCLRunBatchPanicFailsEveryRecord(t *testing.T) {
+	config := testConfig()
+	config.FailurePolicy = FailurePolicyDeadLetter
+	sink := new(deadLetters)
+	config.DeadLetterSink = sink
+	k, err := NewDefaultBatchKCL(config, batchFunc(func(ShardContext, *ProcessRecordsInput) []error {
+		panic("boom")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(testRecord("1", "a"), testRecord("2", "b")), shardEndedLine}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.letters) != 2 {
+		t.Fatalf("dead lettered (%d) records, want both", len(sink.letters))
+	}
+	for _, letter := range sink.letters {
+		if len(letter.Errors) == 0 || letter.Errors[0] != "kclgo: panic: boom" {
+			t.Errorf("record (%s) dead lettered with (%v)", letter.Record.SequenceNumber, letter.Errors)
+		}
+	}
+}
+
+func TestKCLRunPanicInProcessor(t *testing.T) {
+	k, err := NewKCL(testConfig(), new(panickyProcessor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDaemon{messages: []string{initializeLine, shardEndedLine}}
+	err = d.run(t, k)
+	var action *ActionError
+	var p *PanicError
+	if !errors.As(err, &action) || !errors.As(err, &p) || !p.SequenceNumber.IsZero() {
+		t.Fatalf("Run returned (%v), want an *ActionError for a *PanicError", err)
+	}
+	if action.Action != "initialize" || len(d.acks) != 0 {
+		t.Errorf("failed (%s) with (%v) acked", action.Action, d.acks)
+	}
+}
@@ -2,24 +2,217 @@ package kclgo
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Which version of the MultiLangDaemon protocol a record was decoded from
+type ProtocolDialect int
+
+const (
+	DialectUnknown ProtocolDialect = iota
+	// KCL 1.x capitalises SequenceNumber, SubSequenceNumber and Action
+	DialectKCL1
+	// KCL 2.x uses camelCase keys for them
+	DialectKCL2
+)
+
+func (d ProtocolDialect) String() string {
+	switch d {
+	case DialectKCL1:
+		return "KCL1"
+	case DialectKCL2:
+		return "KCL2"
+	default:
+		return "Unknown"
+	}
+}
+
+// Record is marshalled to and from JSON by hand, see recordJSON for the keys
 type Record struct {
+	Data         string
+	PartitionKey string
+	// Only set on user records deaggregated from a KPL aggregated record, when the producer gave one
+	ExplicitHashKey string
+	// Records that weren't aggregated by the KPL have a SubSequenceNumber of 0
+	SequenceNumber ExtendedSequenceNumber
+	// Always in milliseconds since the epoch, no matter what precision the daemon sent it in
+	ApproximateArrivalTimestamp int64
+	Action                      string
+	Dialect                     ProtocolDialect
+
+	// set when KCLConfig.ContentEncoding asks for payloads to be decompressed
+	decoder *ContentDecoder
+}
+
+// The KCL 2.x shape of a record, the sequence numbers are separate keys
+type recordJSON struct {
 	Data                        string `json:"data"`
 	PartitionKey                string `json:"partitionKey"`
-	SequenceNumber              string `json:"SequenceNumber"`
-	ApproximateArrivalTimestamp int    `json:"approximateArrivalTimestamp"`
-	SubSequenceNumber           int    `json:"SubSequenceNumber"`
-	Action                      string `json:"Action"`
+	ExplicitHashKey             string `json:"explicitHashKey,omitempty"`
+	SequenceNumber              string `json:"sequenceNumber"`
+	SubSequenceNumber           int64  `json:"subSequenceNumber"`
+	ApproximateArrivalTimestamp int64  `json:"approximateArrivalTimestamp"`
+	Action                      string `json:"action"`
+}
+
+// Anything before this is too small to be a millisecond timestamp (it's March 1973), so it must be in seconds
+const minMillisTimestamp = 1e11
+
+// Accepts both the KCL 1.x and KCL 2.x shape of a record. Keys match case insensitively like they do for
+// encoding/json, camelCase keys take precedence if a message somehow has more than one casing.
+func (r *Record) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	*r = Record{}
+	// returns the key as it was sent along with its value
+	lookup := func(camel string) (string, json.RawMessage) {
+		capital := strings.ToUpper(camel[:1]) + camel[1:]
+		for _, key := range []string{camel, capital} {
+			if v, there := fields[key]; there {
+				return key, v
+			}
+		}
+		for key, v := range fields {
+			if strings.EqualFold(key, camel) {
+				return key, v
+			}
+		}
+		return "", nil
+	}
+	value := func(camel string) json.RawMessage {
+		_, v := lookup(camel)
+		return v
+	}
+	// the sequence numbers and action are the keys whose casing says which daemon sent the record
+	kcl1, kcl2 := false, false
+	dialectValue := func(camel string) json.RawMessage {
+		key, v := lookup(camel)
+		switch {
+		case key == camel:
+			kcl2 = true
+		case key != "":
+			kcl1 = true
+		}
+		return v
+	}
+
+	if err := decodeString(value("data"), &r.Data); err != nil {
+		return fmt.Errorf("record data: %v", err)
+	}
+	if err := decodeString(value("partitionKey"), &r.PartitionKey); err != nil {
+		return fmt.Errorf("record partitionKey: %v", err)
+	}
+	if err := decodeString(value("explicitHashKey"), &r.ExplicitHashKey); err != nil {
+		return fmt.Errorf("record explicitHashKey: %v", err)
+	}
+	if err := decodeString(dialectValue("sequenceNumber"), &r.SequenceNumber.SequenceNumber); err != nil {
+		return fmt.Errorf("record sequenceNumber: %v", err)
+	}
+	if err := decodeString(dialectValue("action"), &r.Action); err != nil {
+		return fmt.Errorf("record action: %v", err)
+	}
+
+	sub, err := decodeNumber(dialectValue("subSequenceNumber"))
+	if err != nil {
+		return fmt.Errorf("record subSequenceNumber: %v", err)
+	}
+	r.SequenceNumber.SubSequenceNumber = int64(sub)
+
+	ts, err := decodeNumber(value("approximateArrivalTimestamp"))
+	if err != nil {
+		return fmt.Errorf("record approximateArrivalTimestamp: %v", err)
+	}
+	if ts != 0 && math.Abs(ts) < minMillisTimestamp {
+		ts *= 1000
+	}
+	r.ApproximateArrivalTimestamp = int64(math.Round(ts))
+
+	// only the casing of the keys says which daemon sent it, both send an action of "record"
+	switch {
+	case kcl2 && !kcl1:
+		r.Dialect = DialectKCL2
+	case kcl1:
+		r.Dialect = DialectKCL1
+	}
+	return nil
+}
+
+// Missing and null values leave dst alone
+func decodeString(raw json.RawMessage, dst *string) error {
+	if raw == nil {
+		return nil
+	}
+	var s *string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	if s != nil {
+		*dst = *s
+	}
+	return nil
 }
 
-// Return the raw data from the Kinesis Record
+// Numbers may be sent as JSON numbers or as strings, missing and null values are 0
+func decodeNumber(raw json.RawMessage) (float64, error) {
+	if raw == nil {
+		return 0, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return n, nil
+	case string:
+		if n == "" {
+			return 0, nil
+		}
+		return strconv.ParseFloat(n, 64)
+	default:
+		return 0, fmt.Errorf("expected a number, got (%s)", string(raw))
+	}
+}
+
+// Marshals in the KCL 2.x shape, so UnmarshalJSON reads it back the same
+func (r Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recordJSON{
+		Data:                        r.Data,
+		PartitionKey:                r.PartitionKey,
+		ExplicitHashKey:             r.ExplicitHashKey,
+		SequenceNumber:              r.SequenceNumber.SequenceNumber,
+		SubSequenceNumber:           r.SequenceNumber.SubSequenceNumber,
+		ApproximateArrivalTimestamp: r.ApproximateArrivalTimestamp,
+		Action:                      r.Action,
+	})
+}
+
+// Return the data from the Kinesis Record, decompressed if KCLConfig.ContentEncoding says so
 func (r *Record) BinaryData() ([]byte, error) {
+	data, err := r.RawData()
+	if err != nil || r.decoder == nil {
+		return data, err
+	}
+	return r.decoder.Decode(data)
+}
+
+// Return the data from the Kinesis Record as it was put on the stream
+func (r *Record) RawData() ([]byte, error) {
 	return base64.StdEncoding.DecodeString(r.Data)
 }
 
 // return Time parsed from Kinesis timestamp
 func (r *Record) ApproximateArrivalTime() time.Time {
-	return time.Unix(int64(r.ApproximateArrivalTimestamp), 0)
+	ms := r.ApproximateArrivalTimestamp
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
 }
@@ -0,0 +1,97 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRecordUnmarshalJSON(t *testing.T) {
+	seq := func(s string, sub int64) ExtendedSequenceNumber {
+		return ExtendedSequenceNumber{SequenceNumber: s, SubSequenceNumber: sub}
+	}
+	tests := []struct {
+		name string
+		json string
+		want Record
+	}{
+		{
+			name: "KCL 2.x",
+			json: `{"action":"record","data":"e30=","partitionKey":"a","explicitHashKey":"1","sequenceNumber":"12","subSequenceNumber":3,"approximateArrivalTimestamp":1600000000123}`,
+			want: Record{Data: "e30=", PartitionKey: "a", ExplicitHashKey: "1", SequenceNumber: seq("12", 3), ApproximateArrivalTimestamp: 1600000000123, Action: "record", Dialect: DialectKCL2},
+		},
+		{
+			name: "KCL 1.x",
+			json: `{"Action":"record","data":"e30=","partitionKey":"a","SequenceNumber":"12","SubSequenceNumber":3,"approximateArrivalTimestamp":1600000000123}`,
+			want: Record{Data: "e30=", PartitionKey: "a", SequenceNumber: seq("12", 3), ApproximateArrivalTimestamp: 1600000000123, Action: "record", Dialect: DialectKCL1},
+		},
+		{
+			name: "capitalised",
+			json: `{"Action":"record","Data":"e30=","PartitionKey":"a","ExplicitHashKey":"1","SequenceNumber":"12","ApproximateArrivalTimestamp":1600000000123}`,
+			want: Record{Data: "e30=", PartitionKey: "a", ExplicitHashKey: "1", SequenceNumber: seq("12", 0), ApproximateArrivalTimestamp: 1600000000123, Action: "record", Dialect: DialectKCL1},
+		},
+		{
+			// encoding/json would take these too
+			name: "any casing",
+			json: `{"DATA":"e30=","partitionkey":"a","sequenceNUMBER":"12"}`,
+			want: Record{Data: "e30=", PartitionKey: "a", SequenceNumber: seq("12", 0), Dialect: DialectKCL1},
+		},
+		{
+			name: "camelCase wins",
+			json: `{"sequenceNumber":"12","SequenceNumber":"13","data":"e30=","Data":"bm9wZQ=="}`,
+			want: Record{Data: "e30=", SequenceNumber: seq("12", 0), Dialect: DialectKCL2},
+		},
+		{
+			// the casing of the data and partition key doesn't tell the daemons apart
+			name: "dialect from the sequence number",
+			json: `{"Data":"e30=","PartitionKey":"a","sequenceNumber":"12","action":"record"}`,
+			want: Record{Data: "e30=", PartitionKey: "a", SequenceNumber: seq("12", 0), Action: "record", Dialect: DialectKCL2},
+		},
+		{
+			name: "no dialect",
+			json: `{"data":"e30=","partitionKey":"a"}`,
+			want: Record{Data: "e30=", PartitionKey: "a"},
+		},
+		{
+			name: "seconds",
+			json: `{"sequenceNumber":"12","approximateArrivalTimestamp":1600000000.123}`,
+			want: Record{SequenceNumber: seq("12", 0), ApproximateArrivalTimestamp: 1600000000123, Dialect: DialectKCL2},
+		},
+		{
+			name: "numbers as strings",
+			json: `{"sequenceNumber":"12","subSequenceNumber":"3","approximateArrivalTimestamp":"1600000000"}`,
+			want: Record{SequenceNumber: seq("12", 3), ApproximateArrivalTimestamp: 1600000000000, Dialect: DialectKCL2},
+		},
+		{
+			name: "nulls",
+			json: `{"data":null,"sequenceNumber":"12","subSequenceNumber":null,"approximateArrivalTimestamp":null}`,
+			want: Record{SequenceNumber: seq("12", 0), Dialect: DialectKCL2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Record
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got (%+v), want (%+v)", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordUnmarshalJSONErrors(t *testing.T) {
+	for _, line := range []string{
+		`[]`,
+		`{"data":3}`,
+		`{"sequenceNumber":12}`,
+		`{"subSequenceNumber":"three"}`,
+		`{"approximateArrivalTimestamp":true}`,
+	} {
+		var r Record
+		if err := json.Unmarshal([]byte(line), &r); err == nil {
+			t.Errorf("%s unmarshalled without an error", line)
+		}
+	}
+}
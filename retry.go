@@ -0,0 +1,99 @@
+package kclgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how often the DefaultRecordProcessor retries a record that failed before giving up on it.
+// The delay before retry n is BaseDelay * 2^(n-1), capped at MaxDelay, less up to Jitter of itself at random.
+type RetryPolicy struct {
+	// Total attempts per record, 1 (or less) means a record is never retried
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Fraction (0 to 1) of each delay to randomise so retries across shards don't line up
+	Jitter float64
+	// Which errors are worth retrying, nil means DefaultRetryable
+	Retryable func(error) bool
+}
+
+// Retries everything but records whose payload couldn't be decoded, those will never succeed
+func DefaultRetryable(err error) bool {
+	var decodeErr *DecodeError
+	return !errors.As(err, &decodeErr)
+}
+
+// RetryError is returned for a record that still failed after being retried
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("kclgo: failed after (%d) attempts: %s", e.Attempts, e.Err.Error())
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+// The delay before the given retry, the first retry is 1
+func (p RetryPolicy) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		if spread := int64(float64(d) * jitter); spread > 0 {
+			d -= time.Duration(rand.Int63n(spread + 1))
+		}
+	}
+	return d
+}
+
+// Calls fn until it succeeds, returns an error that isn't retryable, runs out of attempts or ctx is done. Errors
+// after more than one attempt are returned as a *RetryError.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	err := fn()
+	attempt := 1
+	for ; err != nil && attempt < p.MaxAttempts && p.retryable(err); attempt++ {
+		if !sleepContext(ctx, p.delay(attempt)) {
+			break
+		}
+		err = fn()
+	}
+	if err != nil && attempt > 1 {
+		return &RetryError{Attempts: attempt, Err: err}
+	}
+	return err
+}
+
+// Returns false if ctx is done before d has passed
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
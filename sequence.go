@@ -0,0 +1,168 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ExtendedSequenceNumber is a Kinesis sequence number together with the position of a KPL user record inside the
+// aggregated record it came in. Records that weren't aggregated have a SubSequenceNumber of 0.
+// The zero value means "no sequence number" and sorts before everything else.
+type ExtendedSequenceNumber struct {
+	SequenceNumber    string
+	SubSequenceNumber int64
+}
+
+// Sentinel checkpoints the KCL uses in place of a real sequence number
+var (
+	TrimHorizon = ExtendedSequenceNumber{SequenceNumber: "TRIM_HORIZON"}
+	Latest      = ExtendedSequenceNumber{SequenceNumber: "LATEST"}
+	AtTimestamp = ExtendedSequenceNumber{SequenceNumber: "AT_TIMESTAMP"}
+	ShardEnd    = ExtendedSequenceNumber{SequenceNumber: "SHARD_END"}
+)
+
+// Sentinels sort by where they are in the shard: TRIM_HORIZON < AT_TIMESTAMP < LATEST < every real sequence number
+// < SHARD_END
+var sentinelRanks = map[string]int{
+	TrimHorizon.SequenceNumber: 1,
+	AtTimestamp.SequenceNumber: 2,
+	Latest.SequenceNumber:      3,
+	ShardEnd.SequenceNumber:    5,
+}
+
+const numericRank = 4
+
+// Parses a sequence number as the KCL sends it, either all digits or one of the sentinels
+func ParseExtendedSequenceNumber(sequenceNumber string, subSequenceNumber int64) (ExtendedSequenceNumber, error) {
+	e := ExtendedSequenceNumber{SequenceNumber: sequenceNumber, SubSequenceNumber: subSequenceNumber}
+	if _, sentinel := sentinelRanks[sequenceNumber]; sentinel {
+		return e, nil
+	}
+	if !isDigits(sequenceNumber) {
+		return ExtendedSequenceNumber{}, fmt.Errorf("could not parse Sequence Number (%s)", sequenceNumber)
+	}
+	if subSequenceNumber < 0 {
+		return ExtendedSequenceNumber{}, fmt.Errorf("negative SubSequenceNumber (%d)", subSequenceNumber)
+	}
+	return e, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (e ExtendedSequenceNumber) IsZero() bool {
+	return e == ExtendedSequenceNumber{}
+}
+
+func (e ExtendedSequenceNumber) IsSentinel() bool {
+	_, sentinel := sentinelRanks[e.SequenceNumber]
+	return sentinel
+}
+
+func (e ExtendedSequenceNumber) rank() int {
+	if e.IsZero() {
+		return 0
+	}
+	if r, sentinel := sentinelRanks[e.SequenceNumber]; sentinel {
+		return r
+	}
+	return numericRank
+}
+
+// Compare returns -1, 0 or +1 depending on whether e sorts before, the same as or after o.
+// Sequence numbers are compared numerically, then by SubSequenceNumber.
+func (e ExtendedSequenceNumber) Compare(o ExtendedSequenceNumber) int {
+	if r, or := e.rank(), o.rank(); r != or {
+		return compareInts(int64(r), int64(or))
+	}
+	if e.rank() == numericRank {
+		// sequence numbers are too big for an int64, but digit strings compare numerically by length first
+		a := strings.TrimLeft(e.SequenceNumber, "0")
+		b := strings.TrimLeft(o.SequenceNumber, "0")
+		if len(a) != len(b) {
+			return compareInts(int64(len(a)), int64(len(b)))
+		}
+		if c := strings.Compare(a, b); c != 0 {
+			return c
+		}
+	}
+	return compareInts(e.SubSequenceNumber, o.SubSequenceNumber)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (e ExtendedSequenceNumber) Less(o ExtendedSequenceNumber) bool {
+	return e.Compare(o) < 0
+}
+
+func (e ExtendedSequenceNumber) Equal(o ExtendedSequenceNumber) bool {
+	return e.Compare(o) == 0
+}
+
+func (e ExtendedSequenceNumber) String() string {
+	if e.SubSequenceNumber == 0 {
+		return e.SequenceNumber
+	}
+	return fmt.Sprintf("%s:%d", e.SequenceNumber, e.SubSequenceNumber)
+}
+
+type extendedSequenceNumberJSON struct {
+	SequenceNumber    string `json:"sequenceNumber"`
+	SubSequenceNumber int64  `json:"subSequenceNumber"`
+}
+
+// Marshals the same way the KCL writes a sequence number in its messages
+func (e ExtendedSequenceNumber) MarshalJSON() ([]byte, error) {
+	return json.Marshal(extendedSequenceNumberJSON{SequenceNumber: e.SequenceNumber, SubSequenceNumber: e.SubSequenceNumber})
+}
+
+// Accepts the object MarshalJSON writes or a bare sequence number string, null leaves e alone like it does for any
+// other type
+func (e *ExtendedSequenceNumber) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var seq string
+	if err := json.Unmarshal(b, &seq); err == nil {
+		parsed, err := ParseExtendedSequenceNumber(seq, 0)
+		if err != nil {
+			return err
+		}
+		*e = parsed
+		return nil
+	}
+
+	var wire extendedSequenceNumberJSON
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+	if wire.SequenceNumber == "" {
+		*e = ExtendedSequenceNumber{}
+		return nil
+	}
+	parsed, err := ParseExtendedSequenceNumber(wire.SequenceNumber, wire.SubSequenceNumber)
+	if err != nil {
+		return err
+	}
+	*e = parsed
+	return nil
+}
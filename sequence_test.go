@@ -0,0 +1,142 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestExtendedSequenceNumberCompare(t *testing.T) {
+	seq := func(s string, sub int64) ExtendedSequenceNumber {
+		return ExtendedSequenceNumber{SequenceNumber: s, SubSequenceNumber: sub}
+	}
+	tests := []struct {
+		name string
+		a, b ExtendedSequenceNumber
+		want int
+	}{
+		{name: "zero first", a: ExtendedSequenceNumber{}, b: TrimHorizon, want: -1},
+		{name: "sentinels", a: TrimHorizon, b: AtTimestamp, want: -1},
+		{name: "latest before real", a: Latest, b: seq("1", 0), want: -1},
+		{name: "shard end last", a: ShardEnd, b: seq("99999999999999999999999999999999999999999999999999", 0), want: 1},
+		{name: "numeric not lexical", a: seq("9", 0), b: seq("10", 0), want: -1},
+		{name: "past an int64", a: seq("49590338271490256608559692538361571095921575989136588898", 0), b: seq("49590338271490256608559692538361571095921575989136588899", 0), want: -1},
+		{name: "leading zeros", a: seq("007", 0), b: seq("7", 0), want: 0},
+		{name: "sub sequence", a: seq("7", 2), b: seq("7", 10), want: -1},
+		{name: "sequence before sub sequence", a: seq("8", 0), b: seq("7", 10), want: 1},
+		{name: "equal", a: seq("7", 3), b: seq("7", 3), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Compare(tt.b); got != tt.want {
+				t.Errorf("(%s).Compare(%s) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := tt.b.Compare(tt.a); got != -tt.want {
+				t.Errorf("(%s).Compare(%s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExtendedSequenceNumber(t *testing.T) {
+	tests := []struct {
+		seq     string
+		sub     int64
+		wantErr bool
+	}{
+		{seq: "49590338271490256608559692538361571095921575989136588898"},
+		{seq: "SHARD_END"},
+		{seq: "12", sub: 3},
+		{seq: "", wantErr: true},
+		{seq: "12a", wantErr: true},
+		{seq: "-12", wantErr: true},
+		{seq: "12", sub: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseExtendedSequenceNumber(tt.seq, tt.sub)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExtendedSequenceNumber(%q, %d) error = (%v), want an error: %v", tt.seq, tt.sub, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExtendedSequenceNumberJSON(t *testing.T) {
+	want := ExtendedSequenceNumber{SequenceNumber: "12", SubSequenceNumber: 3}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got ExtendedSequenceNumber
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("round trip gave (%s), want (%s)", got, want)
+	}
+
+	if err := json.Unmarshal([]byte("null"), &got); err != nil {
+		t.Fatalf("null failed: %v", err)
+	}
+	if got != want {
+		t.Errorf("null changed it to (%s)", got)
+	}
+}
+
+func TestRecordSequenceNumberJSON(t *testing.T) {
+	var r Record
+	line := `{"action":"record","data":"e30=","partitionKey":"a","sequenceNumber":"12","subSequenceNumber":3,"approximateArrivalTimestamp":1}`
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		t.Fatal(err)
+	}
+	want := ExtendedSequenceNumber{SequenceNumber: "12", SubSequenceNumber: 3}
+	if r.SequenceNumber != want {
+		t.Fatalf("unmarshalled (%s), want (%s)", r.SequenceNumber, want)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Record
+	if err := json.Unmarshal(b, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.SequenceNumber != want || again.PartitionKey != "a" {
+		t.Errorf("round trip gave (%+v)", again)
+	}
+}
+
+func TestInitializeInputSequenceNumber(t *testing.T) {
+	tests := []struct {
+		line string
+		want ExtendedSequenceNumber
+	}{
+		{line: `{"action":"initialize","shardId":"s","sequenceNumber":"TRIM_HORIZON","subSequenceNumber":0}`, want: TrimHorizon},
+		{line: `{"action":"initialize","shardId":"s","sequenceNumber":"12","subSequenceNumber":3}`, want: ExtendedSequenceNumber{SequenceNumber: "12", SubSequenceNumber: 3}},
+		{line: `{"action":"initialize","shardId":"s","sequenceNumber":null}`},
+		{line: `{"action":"initialize","shardId":"s"}`},
+	}
+
+	for _, tt := range tests {
+		var i InitializeInput
+		if err := json.Unmarshal([]byte(tt.line), &i); err != nil {
+			t.Errorf("%s failed: %v", tt.line, err)
+			continue
+		}
+		if i.SequenceNumber != tt.want || i.ShardID != "s" {
+			t.Errorf("%s gave (%+v), want (%s)", tt.line, i, tt.want)
+		}
+	}
+}
+
+func TestCheckPointRejectsSentinels(t *testing.T) {
+	c := new(KCLCheckPointer)
+	for _, seq := range []ExtendedSequenceNumber{TrimHorizon, Latest, AtTimestamp, ShardEnd} {
+		seq := seq
+		if _, err := c.CheckPoint(&seq); !errors.Is(err, ErrSentinelCheckPoint) {
+			t.Errorf("checkpoint at (%s) got (%v), want ErrSentinelCheckPoint", seq, err)
+		}
+	}
+}
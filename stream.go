@@ -0,0 +1,266 @@
+package kclgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// RecordStream hands the records of a processRecords message over one at a time as they are decoded, so a
+// multi-megabyte batch never has to be held in memory all at once. Only used when KCLConfig.StreamingDecode
+// is set and the processor implements RecordStreamProcessor.
+type RecordStream struct {
+	mux  sync.Mutex
+	cond *sync.Cond
+	buf  []Record
+	// set while a checkpoint is waiting, the rest of the message has to be read to get to its response
+	spill  bool
+	closed bool
+	done   bool
+	err    error
+
+	decoder *ContentDecoder
+}
+
+func newRecordStream() *RecordStream {
+	s := new(RecordStream)
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+// Returns the next record, false once every record has been returned (or the message couldn't be decoded,
+// see Err)
+func (s *RecordStream) Next() (Record, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.buf) == 0 && !s.done {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		return Record{}, false
+	}
+	r := s.buf[0]
+	r.decoder = s.decoder
+	s.buf = s.buf[1:]
+	s.cond.Broadcast()
+	return r, true
+}
+
+func (s *RecordStream) setContentDecoder(decoder *ContentDecoder) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.decoder = decoder
+}
+
+// The error that stopped the stream early, if any
+func (s *RecordStream) Err() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.err
+}
+
+// Waits until the consumer has taken the previous record, unless we are spilling or the consumer has gone away
+func (s *RecordStream) push(r Record) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.buf) > 0 && !s.spill && !s.closed {
+		s.cond.Wait()
+	}
+	if !s.closed {
+		s.buf = append(s.buf, r)
+	}
+	s.cond.Broadcast()
+}
+
+func (s *RecordStream) finish(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+func (s *RecordStream) spillover() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.spill = true
+	s.cond.Broadcast()
+}
+
+// Called once the processor is done with the stream, anything it didn't read is thrown away
+func (s *RecordStream) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	s.buf = nil
+	s.cond.Broadcast()
+}
+
+// Stops the decoder from reading past the end of a message that is larger than the maximum
+type messageLimitReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *messageLimitReader) Read(p []byte) (int, error) {
+	if l.limit > 0 {
+		if l.read >= l.limit {
+			return 0, ErrMessageTooLarge
+		}
+		if remaining := l.limit - l.read; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// messageStream decodes messages straight off the input with a single json.Decoder. Records are decoded one at a
+// time rather than reading the whole line into a string and unmarshalling a copy of it.
+type messageStream struct {
+	input *messageLimitReader
+	dec   *json.Decoder
+	max   int
+}
+
+func newMessageStream(r io.Reader, max int) *messageStream {
+	s := new(messageStream)
+	s.input = &messageLimitReader{r: r}
+	s.dec = json.NewDecoder(s.input)
+	s.max = max
+	return s
+}
+
+// Reads the next message. When stream is true and the message is a processRecords, the message is dispatched as soon
+// as its records start and the records are pushed to its RecordStream as they are decoded.
+func (s *messageStream) next(d *messageDemux, stream bool) (demuxMessage, error) {
+	if s.max > 0 {
+		s.input.limit = s.dec.InputOffset() + int64(s.max)
+	}
+
+	if err := s.expectDelim('{'); err != nil {
+		return demuxMessage{}, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	var action string
+	var records []Record
+	var streamed *ProcessRecordsInput
+
+	for s.dec.More() {
+		tok, err := s.dec.Token()
+		if err != nil {
+			return demuxMessage{}, err
+		}
+		key, _ := tok.(string)
+
+		if key != "records" {
+			var raw json.RawMessage
+			if err := s.dec.Decode(&raw); err != nil {
+				return demuxMessage{}, err
+			}
+			fields[key] = raw
+			if key == "action" {
+				if err := json.Unmarshal(raw, &action); err != nil {
+					return demuxMessage{}, MalformedAction(err)
+				}
+			}
+			continue
+		}
+
+		if stream && action == "processRecords" {
+			streamed, err = s.streamRecords(d, fields)
+		} else {
+			records, err = s.decodeRecords()
+		}
+		if err != nil {
+			return demuxMessage{}, err
+		}
+	}
+
+	if err := s.expectDelim('}'); err != nil {
+		return demuxMessage{}, err
+	}
+
+	line := summarize(fields)
+	if streamed != nil {
+		// already handed to the Run loop, nothing more to deliver
+		return demuxMessage{line: line}, nil
+	}
+
+	msgInput, err := newAction(action)
+	if err != nil {
+		return demuxMessage{line: line, err: &ProtocolError{Line: line, Err: err}}, nil
+	}
+	if err := json.Unmarshal([]byte(line), msgInput); err != nil {
+		return demuxMessage{line: line, err: &ProtocolError{Line: line, Err: err}}, nil
+	}
+	if p, ok := msgInput.(*ProcessRecordsInput); ok {
+		p.Records = records
+	}
+	return demuxMessage{line: line, action: msgInput}, nil
+}
+
+func (s *messageStream) decodeRecords() ([]Record, error) {
+	if err := s.expectDelim('['); err != nil {
+		return nil, err
+	}
+	var records []Record
+	for s.dec.More() {
+		var r Record
+		if err := s.dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, s.expectDelim(']')
+}
+
+// Only the fields that came before the records are set on the input the processor sees, the MultiLangDaemon puts
+// the action first so the rest are informational.
+func (s *messageStream) streamRecords(d *messageDemux, fields map[string]json.RawMessage) (*ProcessRecordsInput, error) {
+	input := new(ProcessRecordsInput)
+	line := summarize(fields)
+	if err := json.Unmarshal([]byte(line), input); err != nil {
+		return nil, err
+	}
+	input.stream = newRecordStream()
+	d.setStream(input.stream)
+	defer d.setStream(nil)
+	d.dispatch(demuxMessage{line: line, action: input})
+
+	err := s.expectDelim('[')
+	for err == nil && s.dec.More() {
+		var r Record
+		if err = s.dec.Decode(&r); err == nil {
+			input.stream.push(r)
+		}
+	}
+	if err == nil {
+		err = s.expectDelim(']')
+	}
+	input.stream.finish(err)
+	return input, err
+}
+
+func (s *messageStream) expectDelim(delim json.Delim) error {
+	tok, err := s.dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return MalformedAction(fmt.Errorf("expected (%s) but found (%v)", delim, tok))
+	}
+	return nil
+}
+
+// Everything but the records, small enough to log and to unmarshal into the action
+func summarize(fields map[string]json.RawMessage) string {
+	b, _ := json.Marshal(fields)
+	return string(b)
+}
@@ -0,0 +1,156 @@
+package kclgo
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// streamProcessor reads at most readAtMost records of each batch (all of them when 0) and checkpoints at the record
+// checkPointAt while the rest of the batch is still being read.
+type streamProcessor struct {
+	checkpointer CheckPointer
+	readAtMost   int
+	checkPointAt string
+
+	mux       sync.Mutex
+	batches   [][]string
+	streamErr error
+}
+
+func (p *streamProcessor) Initialize(*InitializeInput) error { return nil }
+
+func (p *streamProcessor) ProcessRecords(*ProcessRecordsInput) error {
+	return errors.New("ProcessRecords called instead of ProcessRecordStream")
+}
+
+func (p *streamProcessor) CheckPoint(sequence *ExtendedSequenceNumber) (CheckPointResult, error) {
+	return p.checkpointer.CheckPoint(sequence)
+}
+
+func (p *streamProcessor) Shutdown(*ShutdownInput) error { return nil }
+
+func (p *streamProcessor) ShutdownRequested(*ShutdownRequestedInput) error { return nil }
+
+func (p *streamProcessor) ProcessRecordStream(input *ProcessRecordsInput, records *RecordStream) error {
+	var seqs []string
+	defer func() {
+		p.mux.Lock()
+		p.batches = append(p.batches, seqs)
+		p.mux.Unlock()
+	}()
+	for r, ok := records.Next(); ok; r, ok = records.Next() {
+		seqs = append(seqs, r.SequenceNumber.SequenceNumber)
+		if r.SequenceNumber.SequenceNumber == p.checkPointAt {
+			if _, err := p.checkpointer.CheckPointRecord(r); err != nil {
+				return err
+			}
+		}
+		if len(seqs) == p.readAtMost {
+			return nil
+		}
+	}
+	p.mux.Lock()
+	p.streamErr = records.Err()
+	p.mux.Unlock()
+	return records.Err()
+}
+
+func newStreamKCL(t *testing.T, config *KCLConfig, p *streamProcessor) *KCL {
+	t.Helper()
+	config.StreamingDecode = true
+	k, err := NewKCL(config, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.checkpointer = k.checkpointer
+	return k
+}
+
+func TestRecordStreamCheckPointMidStream(t *testing.T) {
+	p := &streamProcessor{checkPointAt: "1"}
+	k := newStreamKCL(t, testConfig(), p)
+
+	// the checkpoint response is queued up behind records 2 and 3
+	d := &fakeDaemon{messages: []string{
+		initializeLine,
+		processRecordsLine(testRecord("1", "a"), testRecord("2", "a"), testRecord("3", "a")),
+		processRecordsLine(testRecord("4", "a")),
+		shardEndedLine,
+	}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.checkpointed(); !equalStrings(got, []string{"1"}) {
+		t.Errorf("checkpointed at (%v), want [1]", got)
+	}
+	if len(p.batches) != 2 || !equalStrings(p.batches[0], []string{"1", "2", "3"}) || !equalStrings(p.batches[1], []string{"4"}) {
+		t.Errorf("read (%v), want [[1 2 3] [4]]", p.batches)
+	}
+	if want := []string{"initialize", "processRecords", "processRecords", "shardEnded"}; !equalStrings(d.acks, want) {
+		t.Errorf("acked (%v), want (%v)", d.acks, want)
+	}
+}
+
+func TestRecordStreamReturnsEarly(t *testing.T) {
+	p := &streamProcessor{readAtMost: 1}
+	k := newStreamKCL(t, testConfig(), p)
+
+	d := &fakeDaemon{messages: []string{
+		initializeLine,
+		processRecordsLine(testRecord("1", "a"), testRecord("2", "a"), testRecord("3", "a")),
+		processRecordsLine(testRecord("4", "a"), testRecord("5", "a")),
+		shardEndedLine,
+	}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	// what wasn't read is dropped rather than held up or handed to the next batch
+	if len(p.batches) != 2 || !equalStrings(p.batches[0], []string{"1"}) || !equalStrings(p.batches[1], []string{"4"}) {
+		t.Errorf("read (%v), want [[1] [4]]", p.batches)
+	}
+	if want := []string{"initialize", "processRecords", "processRecords", "shardEnded"}; !equalStrings(d.acks, want) {
+		t.Errorf("acked (%v), want (%v)", d.acks, want)
+	}
+}
+
+func TestRecordStreamMessageTooLarge(t *testing.T) {
+	config := testConfig()
+	config.MaxMessageBytes = 300
+	p := new(streamProcessor)
+	k := newStreamKCL(t, config, p)
+
+	var records []Record
+	for _, seq := range []string{"1", "2", "3", "4", "5", "6"} {
+		records = append(records, testRecord(seq, "a"))
+	}
+	d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(records...), shardEndedLine}}
+	if err := d.run(t, k); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Run() returned (%v), want ErrMessageTooLarge", err)
+	}
+	if !errors.Is(p.streamErr, ErrMessageTooLarge) {
+		t.Errorf("stream ended with (%v), want ErrMessageTooLarge", p.streamErr)
+	}
+	if len(p.batches) != 1 || len(p.batches[0]) == 0 || len(p.batches[0]) == len(records) {
+		t.Errorf("read (%v), want the records that fit", p.batches)
+	}
+}
+
+func TestReadLineMessageTooLarge(t *testing.T) {
+	config := testConfig()
+	config.MaxMessageBytes = 40
+	short := strings.Repeat("a", 39) + "\n"
+	long := strings.Repeat("b", 40) + "\n"
+	// a reader smaller than a line so the line is read in fragments
+	h := &IoHandler{config: config, reader: bufio.NewReaderSize(strings.NewReader(short+long), 16)}
+
+	line, err := h.ReadLine()
+	if err != nil || line != short {
+		t.Errorf("ReadLine() = (%q, %v), want (%q)", line, err, short)
+	}
+	if _, err := h.ReadLine(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("ReadLine() returned (%v), want ErrMessageTooLarge", err)
+	}
+}
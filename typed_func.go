@@ -0,0 +1,115 @@
+package kclgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Decoder turns the payload of a record into a T
+type Decoder[T any] interface {
+	Decode(data []byte) (T, error)
+}
+
+// DecoderFunc adapts a plain function to a Decoder
+type DecoderFunc[T any] func(data []byte) (T, error)
+
+func (f DecoderFunc[T]) Decode(data []byte) (T, error) {
+	return f(data)
+}
+
+// Unmarshals JSON payloads into a T
+func JSONDecoder[T any]() Decoder[T] {
+	return DecoderFunc[T](func(data []byte) (T, error) {
+		var v T
+		err := json.Unmarshal(data, &v)
+		return v, err
+	})
+}
+
+// Hands the payload over as is
+func RawDecoder() Decoder[[]byte] {
+	return DecoderFunc[[]byte](func(data []byte) ([]byte, error) {
+		return data, nil
+	})
+}
+
+// Splits a text payload into lines, without their line endings
+func TextLinesDecoder() Decoder[[]string] {
+	return DecoderFunc[[]string](func(data []byte) ([]string, error) {
+		var lines []string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return lines, scanner.Err()
+	})
+}
+
+// RecordMeta is everything about a record but its payload
+type RecordMeta struct {
+	PartitionKey           string
+	SequenceNumber         ExtendedSequenceNumber
+	ApproximateArrivalTime time.Time
+}
+
+func newRecordMeta(r Record) RecordMeta {
+	return RecordMeta{
+		PartitionKey:           r.PartitionKey,
+		SequenceNumber:         r.SequenceNumber,
+		ApproximateArrivalTime: r.ApproximateArrivalTime(),
+	}
+}
+
+// DecodeError is returned by a typed processing func when a record's payload couldn't be decoded, so bad data can
+// be told apart from a failure in the handler with errors.As
+type DecodeError struct {
+	SequenceNumber ExtendedSequenceNumber
+	Err            error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("kclgo: could not decode record (%s): %s", e.SequenceNumber, e.Err.Error())
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+var _ ContextRecordProcessingFunc = (*TypedProcessingFunc[any])(nil)
+
+// TypedProcessingFunc decodes each record's payload with a Decoder before handing it to a typed handler
+type TypedProcessingFunc[T any] struct {
+	decoder Decoder[T]
+	handle  func(context.Context, T, RecordMeta) error
+}
+
+func (t *TypedProcessingFunc[T]) ProcessRecord(record Record) error {
+	return t.ProcessRecordContext(context.Background(), record)
+}
+
+func (t *TypedProcessingFunc[T]) ProcessRecordContext(ctx context.Context, record Record) error {
+	data, err := record.BinaryData()
+	if err != nil {
+		return &DecodeError{SequenceNumber: record.SequenceNumber, Err: err}
+	}
+	v, err := t.decoder.Decode(data)
+	if err != nil {
+		return &DecodeError{SequenceNumber: record.SequenceNumber, Err: err}
+	}
+	return t.handle(ctx, v, newRecordMeta(record))
+}
+
+// Builds a RecordProcessingFunc from a decoder and a typed handler, e.g.
+//
+//	NewTypedProcessingFunc(JSONDecoder[Order](), func(ctx context.Context, o Order, meta RecordMeta) error { ... })
+func NewTypedProcessingFunc[T any](decoder Decoder[T], handle func(context.Context, T, RecordMeta) error) *TypedProcessingFunc[T] {
+	t := new(TypedProcessingFunc[T])
+	t.decoder = decoder
+	t.handle = handle
+	return t
+}
@@ -0,0 +1,164 @@
+package kclgo
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// Records that were never handed to the processing func because an earlier one (for the same partition key when
+// processing concurrently) failed or the batch was cancelled
+var errNotProcessed = errors.New("kclgo: record not processed after an earlier failure")
+
+// Processes the records with a pool of workers and returns the outcome of every record. Each partition key is always
+// handled by the same worker, so records with the same key are processed in the order they were delivered and once
+// one of them fails for good the rest of that key is skipped.
+func (k *DefaultRecordProcessor) processConcurrently(ctx context.Context, records []Record, workers int) []error {
+	errs := make([]error, len(records))
+	done := newWatermark(k.largestSeq, records)
+	if k.funcCheckPoints {
+		k.setWatermark(done)
+		defer k.setWatermark(nil)
+	}
+	queues := make([][]int, workers)
+	for i, r := range records {
+		w := partitionWorker(r.PartitionKey, workers)
+		queues[w] = append(queues[w], i)
+	}
+
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		if len(queue) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(queue []int) {
+			defer wg.Done()
+			failed := make(map[string]bool)
+			for _, i := range queue {
+				r := records[i]
+				if failed[r.PartitionKey] || ctx.Err() != nil {
+					errs[i] = errNotProcessed
+					continue
+				}
+				// nothing recovers a panic in this goroutine but us, and the failure policy can panic too (e.g. in a
+				// dead letter sink) so it fails the record like any other error
+				err := recoverPanic(k.config.ErrLogger, r.SequenceNumber, func() error {
+					if err := k.processRecord(ctx, r); err != nil {
+						return k.handleFailure(ctx, r, err)
+					}
+					return nil
+				})
+				if err != nil {
+					errs[i] = err
+					failed[r.PartitionKey] = true
+					continue
+				}
+				done.complete(i)
+			}
+		}(queue)
+	}
+	wg.Wait()
+
+	// the func won't ask again for a checkpoint that was held back, so make it now the workers are done. It can only
+	// still be held back by a record that failed.
+	if seq, held := done.heldBack(); held {
+		if _, err := k.CheckPoint(&seq); err != nil {
+			k.config.ErrLogger.Printf("Error (%s) making the checkpoint at (%s) that was held back\n", err.Error(), seq)
+		}
+	}
+	return errs
+}
+
+// watermark tracks which records of a batch being processed concurrently are done with, so a checkpoint from the
+// processing func never moves past a record another worker hasn't finished
+type watermark struct {
+	mux  sync.Mutex
+	base ExtendedSequenceNumber
+	seqs []ExtendedSequenceNumber
+	done []bool
+	// every record before this one is done with
+	next int
+	// the furthest checkpoint that was held back and not asked for since
+	wanted ExtendedSequenceNumber
+	held   bool
+}
+
+func newWatermark(base ExtendedSequenceNumber, records []Record) *watermark {
+	w := new(watermark)
+	w.base = base
+	w.seqs = make([]ExtendedSequenceNumber, len(records))
+	for i, r := range records {
+		w.seqs[i] = r.SequenceNumber
+	}
+	w.done = make([]bool, len(records))
+	return w
+}
+
+func (w *watermark) complete(i int) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.done[i] = true
+	for w.next < len(w.done) && w.done[w.next] {
+		w.next++
+	}
+}
+
+// The furthest a checkpoint at seq may go (nil meaning the end of the batch) and whether that is short of seq. The
+// func may vouch for the first record that isn't done (it is most likely the one asking) but nothing after it. Zero if
+// nothing can be checkpointed yet.
+func (w *watermark) limit(seq *ExtendedSequenceNumber) (ExtendedSequenceNumber, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	limit, held := w.limitLocked(seq)
+	switch {
+	case held && seq != nil:
+		w.hold(*seq)
+	case held && len(w.seqs) > 0:
+		w.hold(w.seqs[len(w.seqs)-1])
+	case !held && w.held && !limit.Less(w.wanted):
+		w.held = false
+	}
+	return limit, held
+}
+
+func (w *watermark) hold(seq ExtendedSequenceNumber) {
+	if !w.held || w.wanted.Less(seq) {
+		w.wanted = seq
+		w.held = true
+	}
+}
+
+func (w *watermark) limitLocked(seq *ExtendedSequenceNumber) (ExtendedSequenceNumber, bool) {
+	if w.next == len(w.seqs) {
+		if seq == nil && len(w.seqs) > 0 {
+			return w.seqs[len(w.seqs)-1], false
+		}
+	} else if seq != nil && !w.seqs[w.next].Less(*seq) {
+		return *seq, false
+	}
+
+	high := w.base
+	if w.next > 0 {
+		high = w.seqs[w.next-1]
+	}
+	if seq != nil && !high.Less(*seq) {
+		return *seq, false
+	}
+	return high, true
+}
+
+// The furthest checkpoint that was held back and hasn't been made since, if any
+func (w *watermark) heldBack() (ExtendedSequenceNumber, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.wanted, w.held
+}
+
+func partitionWorker(partitionKey string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(partitionKey))
+	return int(h.Sum32() % uint32(workers))
+}
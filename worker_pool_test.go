@@ -0,0 +1,176 @@
+package kclgo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestWatermarkLimit(t *testing.T) {
+	seq := func(s string) *ExtendedSequenceNumber {
+		return &ExtendedSequenceNumber{SequenceNumber: s}
+	}
+	records := []Record{testRecord("1", "a"), testRecord("2", "b"), testRecord("3", "c"), testRecord("4", "d")}
+	tests := []struct {
+		name     string
+		base     string
+		done     []int
+		seq      *ExtendedSequenceNumber
+		want     string
+		wantHeld bool
+	}{
+		{name: "nothing done", seq: seq("2"), wantHeld: true},
+		{name: "nothing done at the end", wantHeld: true},
+		{name: "the first not done vouched for", seq: seq("1"), want: "1"},
+		{name: "back to the base", base: "0", seq: seq("3"), want: "0", wantHeld: true},
+		{name: "behind the base", base: "0", seq: seq("0"), want: "0"},
+		{name: "done with", done: []int{0, 1}, seq: seq("2"), want: "2"},
+		{name: "held back", done: []int{0, 1}, seq: seq("4"), want: "2", wantHeld: true},
+		{name: "gap", done: []int{0, 1, 3}, seq: seq("4"), want: "2", wantHeld: true},
+		{name: "at the end held back", done: []int{0, 1, 3}, want: "2", wantHeld: true},
+		{name: "all done at the end", done: []int{0, 1, 2, 3}, want: "4"},
+		{name: "done out of order", done: []int{3, 2, 1, 0}, seq: seq("4"), want: "4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base ExtendedSequenceNumber
+			if tt.base != "" {
+				base = *seq(tt.base)
+			}
+			w := newWatermark(base, records)
+			for _, i := range tt.done {
+				w.complete(i)
+			}
+			got, held := w.limit(tt.seq)
+			if got.SequenceNumber != tt.want || held != tt.wantHeld {
+				t.Errorf("limit() = (%s, %v), want (%s, %v)", got, held, tt.want, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestWatermarkHeldBack(t *testing.T) {
+	seq := func(s string) *ExtendedSequenceNumber {
+		return &ExtendedSequenceNumber{SequenceNumber: s}
+	}
+	w := newWatermark(ExtendedSequenceNumber{}, []Record{testRecord("1", "a"), testRecord("2", "b"), testRecord("3", "c")})
+	if _, held := w.heldBack(); held {
+		t.Fatal("held back before a checkpoint was asked for")
+	}
+
+	w.limit(seq("2"))
+	w.limit(seq("1"))
+	if got, held := w.heldBack(); !held || got.SequenceNumber != "2" {
+		t.Errorf("heldBack() = (%s, %v), want the furthest asked for", got, held)
+	}
+	w.limit(nil)
+	if got, held := w.heldBack(); !held || got.SequenceNumber != "3" {
+		t.Errorf("heldBack() = (%s, %v), want the end of the batch", got, held)
+	}
+
+	w.complete(0)
+	w.complete(1)
+	w.limit(seq("2"))
+	if got, held := w.heldBack(); !held || got.SequenceNumber != "3" {
+		t.Errorf("heldBack() = (%s, %v) after a checkpoint short of it", got, held)
+	}
+	w.complete(2)
+	w.limit(seq("3"))
+	if got, held := w.heldBack(); held {
+		t.Errorf("heldBack() = (%s, %v) once it was made", got, held)
+	}
+}
+
+func TestProcessConcurrentlyKeepsKeyOrder(t *testing.T) {
+	config := testConfig()
+	config.ProcessingWorkers = 4
+
+	var mux sync.Mutex
+	byKey := make(map[string][]string)
+	k, err := NewDefaultKCL(config, RecordFunc(func(record Record) error {
+		mux.Lock()
+		defer mux.Unlock()
+		byKey[record.PartitionKey] = append(byKey[record.PartitionKey], record.SequenceNumber.SequenceNumber)
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Record
+	want := make(map[string][]string)
+	for i := 1; i <= 60; i++ {
+		r := testRecord(fmt.Sprint(i), fmt.Sprint("key", i%7))
+		records = append(records, r)
+		want[r.PartitionKey] = append(want[r.PartitionKey], r.SequenceNumber.SequenceNumber)
+	}
+	d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(records...), shardEndedLine}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	for key, seqs := range want {
+		if !equalStrings(byKey[key], seqs) {
+			t.Errorf("processed (%s) in the order (%v), want (%v)", key, byKey[key], seqs)
+		}
+	}
+	if got := d.checkpointed(); !equalStrings(got, []string{"60", ""}) {
+		t.Errorf("checkpointed at (%v), want [60 ]", got)
+	}
+}
+
+// checkPointingFunc checkpoints every record as soon as it is processed. Record 1 isn't processed until record 6 has
+// asked to be checkpointed.
+type checkPointingFunc struct {
+	checkpointer CheckPointer
+	asked        chan struct{}
+}
+
+func (f *checkPointingFunc) SetCheckPointer(c CheckPointer) {
+	f.checkpointer = c
+}
+
+func (f *checkPointingFunc) ProcessRecord(record Record) error {
+	seq := record.SequenceNumber.SequenceNumber
+	if seq == "1" {
+		<-f.asked
+	}
+	_, err := f.checkpointer.CheckPointRecord(record)
+	if seq == "6" {
+		close(f.asked)
+	}
+	return err
+}
+
+func TestProcessConcurrentlyMakesHeldBackCheckPoint(t *testing.T) {
+	const workers = 6
+	config := testConfig()
+	config.ProcessingWorkers = workers
+
+	// records 1 and 6 must be on different workers
+	keys := []string{"a"}
+	for i := 0; len(keys) < workers; i++ {
+		key := fmt.Sprint("key", i)
+		if len(keys) < workers-1 || partitionWorker(key, workers) != partitionWorker(keys[0], workers) {
+			keys = append(keys, key)
+		}
+	}
+	var records []Record
+	for i, key := range keys {
+		records = append(records, testRecord(fmt.Sprint(i+1), key))
+	}
+
+	k, err := NewDefaultKCL(config, &checkPointingFunc{asked: make(chan struct{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDaemon{messages: []string{initializeLine, processRecordsLine(records...), shardEndedLine}}
+	if err := d.run(t, k); err != nil {
+		t.Fatal(err)
+	}
+	// the checkpoint record 6 asked for was held back as record 1 wasn't done, then made once it was
+	got := d.checkpointed()
+	if len(got) < 2 || got[len(got)-2] != "6" || got[len(got)-1] != "" {
+		t.Errorf("checkpointed at (%v), want the held back checkpoint at (6) before the end of the shard", got)
+	}
+}